@@ -4,14 +4,13 @@ go 1.12
 
 require (
 	github.com/Microsoft/go-winio v0.4.16 // indirect
-	github.com/containernetworking/cni v0.8.1
+	github.com/containernetworking/cni v1.1.2
 	github.com/googleapis/gnostic v0.2.0 // indirect
 	github.com/json-iterator/go v1.1.9 // indirect
 	github.com/kaloom/kubernetes-common v0.1.4
-	github.com/onsi/gomega v1.10.3 // indirect
 	github.com/stretchr/objx v0.2.0 // indirect
-	golang.org/x/net v0.0.0-20201006153459-a7d1128ccaa0
-	golang.org/x/sys v0.0.0-20201117170446-d9b008d0a637 // indirect
+	golang.org/x/net v0.0.0-20210428140749-89ef3d95e781
+	golang.org/x/sys v0.0.0-20210423082822-04245dca01da
 	gopkg.in/check.v1 v1.0.0-20190902080502-41f04d3bba15 // indirect
 	k8s.io/api v0.18.3
 	k8s.io/apimachinery v0.18.3
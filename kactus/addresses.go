@@ -0,0 +1,97 @@
+/*
+Copyright (c) 2021 Kaloom Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/containernetworking/cni/pkg/types"
+	types100 "github.com/containernetworking/cni/pkg/types/100"
+)
+
+// static addresses requested for a network attachment with the ips and
+// gateway attributes of the networks Pod annotation; they are passed to
+// the delegate as the ips runtimeConfig capability and as the IP and
+// GATEWAY CNI_ARGS, which the static ipam supports
+
+// validate the ips and gateway requested for a network attachment, an ip
+// is an address along with its prefix length (ex. 10.1.1.2/24) and the
+// gateway must be in the subnet of one of them
+func validateIPRequest(podNet networkConfig) error {
+	var subnets []*net.IPNet
+	seen := make(map[string]bool)
+	for _, ip := range podNet.IPs {
+		addr, subnet, err := net.ParseCIDR(ip)
+		if err != nil {
+			return fmt.Errorf("invalid ip %q, it must be an address along with its prefix length (ex. 10.1.1.2/24)", ip)
+		}
+		if seen[addr.String()] {
+			return fmt.Errorf("ip %s is requested more than once", addr)
+		}
+		seen[addr.String()] = true
+		subnets = append(subnets, subnet)
+	}
+
+	if podNet.Gateway == "" {
+		return nil
+	}
+	gw := net.ParseIP(podNet.Gateway)
+	if gw == nil {
+		return fmt.Errorf("invalid gateway %q", podNet.Gateway)
+	}
+	if len(subnets) == 0 {
+		return fmt.Errorf("gateway %s requires ips", gw)
+	}
+	for _, subnet := range subnets {
+		if subnet.Contains(gw) {
+			return nil
+		}
+	}
+	return fmt.Errorf("gateway %s is not in the subnet of any of the ips %s", gw, strings.Join(podNet.IPs, ", "))
+}
+
+// make sure that the addresses requested for a network attachment are
+// the ones the delegate assigned, a delegate whose ipam doesn't support
+// static addresses would silently ignore them
+func checkAssignedIPs(podNet networkConfig, r types.Result) error {
+	if len(podNet.IPs) == 0 {
+		return nil
+	}
+	res, err := types100.NewResultFromResult(r)
+	if err != nil {
+		return fmt.Errorf("failed to convert the result of network %s: %v", podNet.NetworkName, err)
+	}
+
+	assigned := make(map[string]bool, len(res.IPs))
+	for _, ipc := range res.IPs {
+		assigned[ipc.Address.String()] = true
+	}
+	var missing []string
+	for _, ip := range podNet.IPs {
+		addr, subnet, _ := net.ParseCIDR(ip)
+		subnet.IP = addr
+		if !assigned[subnet.String()] {
+			missing = append(missing, ip)
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("the delegate of network %s didn't assign the requested ips %s, its ipam must support static addresses (ex. the static ipam)", podNet.NetworkName, strings.Join(missing, ", "))
+	}
+	return nil
+}
@@ -0,0 +1,108 @@
+/*
+Copyright (c) 2021 Kaloom Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"runtime"
+	"time"
+
+	kc "github.com/kaloom/kubernetes-common"
+
+	"k8s.io/client-go/rest"
+)
+
+// the settings of the requests kactus sends to the apiserver: a request
+// times out after apiTimeout and the Pod and network attachment lookups
+// are retried, with an exponential backoff, when they fail with a
+// transient error (see isTransientError)
+
+const (
+	defaultAPITimeout      = 10 * time.Second
+	defaultAPIRetries      = 3
+	defaultAPIRetryBackoff = 250 * time.Millisecond
+)
+
+// the user agent of kactus requests, in the format of the kubernetes
+// clients' one: kactus/<version> (<os>/<arch>) kactus/<commit>
+func getUserAgent() string {
+	return fmt.Sprintf("kactus/%s (%s/%s) kactus/%s", branch, runtime.GOOS, runtime.GOARCH, commit)
+}
+
+// set the apiserver settings of kactus config in a client config
+func (nc *netConf) setAPIConfig(cfg *rest.Config) {
+	cfg.UserAgent = getUserAgent()
+	cfg.Timeout = defaultAPITimeout
+	if nc.APITimeout != "" {
+		cfg.Timeout, _ = time.ParseDuration(nc.APITimeout)
+	}
+	if nc.APIQPS > 0 {
+		cfg.QPS = nc.APIQPS
+		cfg.Burst = nc.APIBurst
+		if cfg.Burst == 0 {
+			cfg.Burst = rest.DefaultBurst
+		}
+	} else if nc.APIBurst > 0 {
+		cfg.Burst = nc.APIBurst
+	}
+}
+
+// validate the apiserver settings of kactus config
+func (nc *netConf) validateAPIConfig() error {
+	for field, value := range map[string]string{"apiTimeout": nc.APITimeout, "apiRetryBackoff": nc.APIRetryBackoff} {
+		if value == "" {
+			continue
+		}
+		if d, err := time.ParseDuration(value); err != nil || d < 0 {
+			return fmt.Errorf("invalid %s %q, it must be a positive duration (ex. 10s)", field, value)
+		}
+	}
+	if nc.APIRetries != nil && *nc.APIRetries < 0 {
+		return fmt.Errorf("invalid apiRetries %d, it can't be negative", *nc.APIRetries)
+	}
+	if nc.APIQPS < 0 {
+		return fmt.Errorf("invalid apiQPS %v, it can't be negative", nc.APIQPS)
+	}
+	if nc.APIBurst < 0 {
+		return fmt.Errorf("invalid apiBurst %d, it can't be negative", nc.APIBurst)
+	}
+	return nil
+}
+
+// run a request to the apiserver, it's retried while it fails with a
+// transient error, up to apiRetries times with a backoff doubling from
+// apiRetryBackoff on
+func (nc *netConf) retryAPI(what string, request func() error) error {
+	retries := defaultAPIRetries
+	if nc.APIRetries != nil {
+		retries = *nc.APIRetries
+	}
+	backoff := defaultAPIRetryBackoff
+	if nc.APIRetryBackoff != "" {
+		backoff, _ = time.ParseDuration(nc.APIRetryBackoff)
+	}
+
+	for attempt := 0; ; attempt++ {
+		err := request()
+		if err == nil || attempt == retries || !isTransientError(err) {
+			return err
+		}
+		kc.LogInfo("retryAPI: %s failed, retrying in %s (%d/%d): %v\n", what, backoff, attempt+1, retries, err)
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
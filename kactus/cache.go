@@ -0,0 +1,238 @@
+/*
+Copyright (c) 2021 Kaloom Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	kc "github.com/kaloom/kubernetes-common"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// a node-local cache, under the kactus data directory, of the objects ADD
+// gets off the apiserver, i.e. the Pods networks annotations and the
+// network attachment objects: an entry younger than cacheTTL is used as
+// is, an older one is refreshed off the apiserver and, when the apiserver
+// can't be reached or fails, it keeps being used up to cacheMaxStale after
+// it expired so that the Pods on the node keep starting through an
+// apiserver outage; objects that are not found are cached as well
+
+const (
+	// the cache directory, it's hidden to not be taken for a container's
+	// store by the garbage collector
+	objectCacheDir = ".cache"
+
+	defaultCacheTTL      = 30 * time.Second
+	defaultCacheMaxStale = 24 * time.Hour
+)
+
+type cacheEntry struct {
+	Fetched time.Time       `json:"fetched"`
+	Object  json.RawMessage `json:"object,omitempty"`
+	// the message of the apiserver when the object was not found
+	NotFound string `json:"notFound,omitempty"`
+}
+
+type objectCache struct {
+	dir      string
+	ttl      time.Duration
+	maxStale time.Duration
+}
+
+// returns the cache of kactus config, nil if it's disabled
+func newObjectCache(nc *netConf) *objectCache {
+	ttl, maxStale := defaultCacheTTL, defaultCacheMaxStale
+	if nc.CacheTTL != "" {
+		ttl, _ = time.ParseDuration(nc.CacheTTL)
+	}
+	if nc.CacheMaxStale != "" {
+		maxStale, _ = time.ParseDuration(nc.CacheMaxStale)
+	}
+	if ttl <= 0 && maxStale <= 0 {
+		return nil
+	}
+	return &objectCache{
+		dir:      filepath.Join(nc.CNIDir, objectCacheDir),
+		ttl:      ttl,
+		maxStale: maxStale,
+	}
+}
+
+// the file of an entry, the parts of its key are escaped so that an entry
+// is a file of the cache directory
+func (c *objectCache) path(key []string) string {
+	parts := make([]string, len(key))
+	for i, part := range key {
+		parts[i] = strings.Replace(url.PathEscape(part), "_", "%5F", -1)
+	}
+	return filepath.Join(c.dir, strings.Join(parts, "_")+".json")
+}
+
+func (c *objectCache) load(key []string) *cacheEntry {
+	data, err := ioutil.ReadFile(c.path(key))
+	if err != nil {
+		return nil
+	}
+	entry := &cacheEntry{}
+	if err := json.Unmarshal(data, entry); err != nil {
+		kc.LogError("objectCache: ignoring the unparsable entry %s: %v\n", c.path(key), err)
+		return nil
+	}
+	return entry
+}
+
+// write an entry to a temporary file that gets renamed over the entry, the
+// cache is shared by the kactus instances running on the node
+func (c *objectCache) save(key []string, entry *cacheEntry) {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		kc.LogError("objectCache: failed to serialize the entry %s: %v\n", c.path(key), err)
+		return
+	}
+	if err := os.MkdirAll(c.dir, 0700); err != nil {
+		kc.LogError("objectCache: failed to create the cache directory(%q): %v\n", c.dir, err)
+		return
+	}
+	path := c.path(key)
+	f, err := ioutil.TempFile(c.dir, filepath.Base(path)+"*"+tmpFileSuffix)
+	if err != nil {
+		kc.LogError("objectCache: failed to create the entry %s: %v\n", path, err)
+		return
+	}
+	_, err = f.Write(data)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), path)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		kc.LogError("objectCache: failed to write the entry %s: %v\n", path, err)
+	}
+}
+
+// the object of an entry, an object that was not found is returned as
+// the NotFound error of the apiserver
+func (e *cacheEntry) get() ([]byte, error) {
+	if e.NotFound != "" {
+		return nil, &apierrors.StatusError{ErrStatus: metav1.Status{
+			Status:  metav1.StatusFailure,
+			Code:    http.StatusNotFound,
+			Reason:  metav1.StatusReasonNotFound,
+			Message: e.NotFound,
+		}}
+	}
+	return e.Object, nil
+}
+
+// returns the JSON-formatted object of a key, off the cache while its entry
+// didn't expire, otherwise off fetch; the entry is used past its expiry when
+// fetch fails with a transient error (see isTransientError)
+func (c *objectCache) get(key []string, fetch func() ([]byte, error)) ([]byte, error) {
+	if c == nil {
+		return fetch()
+	}
+
+	entry := c.load(key)
+	var age time.Duration
+	if entry != nil {
+		age = time.Since(entry.Fetched)
+		if age >= 0 && age < c.ttl {
+			kc.LogDebug("objectCache: %s got fetched %s ago, using the cache\n", strings.Join(key, "/"), age)
+			return entry.get()
+		}
+	}
+
+	data, err := fetch()
+	switch {
+	case err == nil:
+		c.save(key, &cacheEntry{Fetched: time.Now(), Object: data})
+	case apierrors.IsNotFound(err):
+		c.save(key, &cacheEntry{Fetched: time.Now(), NotFound: err.Error()})
+	case entry != nil && isTransientError(err) && age >= 0 && age < c.ttl+c.maxStale:
+		kc.LogInfo("objectCache: failed to fetch %s, using the one fetched %s ago: %v\n", strings.Join(key, "/"), age, err)
+		return entry.get()
+	}
+	return data, err
+}
+
+// remove the entries that can no longer be used, returns the number of
+// removed entries
+func (c *objectCache) prune() (int, error) {
+	if c == nil {
+		return 0, nil
+	}
+	entries, err := ioutil.ReadDir(c.dir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return 0, nil
+		}
+		return 0, fmt.Errorf("failed to read the cache directory(%q): %v", c.dir, err)
+	}
+
+	var removed int
+	for _, entry := range entries {
+		// the entries are written once fetched, the modification time of
+		// a file is when its object got fetched
+		if entry.IsDir() || time.Since(entry.ModTime()) < c.ttl+c.maxStale {
+			continue
+		}
+		if err := os.Remove(filepath.Join(c.dir, entry.Name())); err == nil {
+			removed++
+		}
+	}
+	return removed, nil
+}
+
+// tells if an error of a request to the apiserver is transient, i.e. the
+// apiserver couldn't be reached (connection refused, timeouts, etc), it
+// failed to serve the request (5xx) or it throttled it (429); any other
+// error, ex. the apiserver rejecting the request or a response that
+// can't be decoded, is permanent
+func isTransientError(err error) bool {
+	if status, ok := err.(apierrors.APIStatus); ok {
+		code := status.Status().Code
+		return code >= http.StatusInternalServerError || code == http.StatusTooManyRequests ||
+			apierrors.IsInternalError(err) || apierrors.IsServerTimeout(err) || apierrors.IsTimeout(err) ||
+			apierrors.IsTooManyRequests(err) || apierrors.IsServiceUnavailable(err)
+	}
+	if errors.Is(err, syscall.ECONNREFUSED) {
+		return true
+	}
+	// the client wraps its errors in an url.Error which is a net.Error
+	// itself, only the errors of the network operations count
+	var opErr *net.OpError
+	if errors.As(err, &opErr) {
+		return true
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
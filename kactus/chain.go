@@ -0,0 +1,210 @@
+/*
+Copyright (c) 2021 Kaloom Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+
+	kc "github.com/kaloom/kubernetes-common"
+
+	"github.com/containernetworking/cni/pkg/invoke"
+	"github.com/containernetworking/cni/pkg/types"
+)
+
+// fields injected by kactus in a delegate netconf that are propagated to
+// each plugin of a plugin chain
+var kactusChainFields = []string{"networkName", "networkNamespace", "deviceID", "resourceName"}
+
+// a delegate is a plugin chain when its netconf is a CNI network
+// configuration list, i.e. it has a "plugins" array
+func isPluginChain(netconf map[string]interface{}) bool {
+	_, ok := netconf["plugins"]
+	return ok
+}
+
+// returns the plugins of a plugin chain after validating them
+func getChainPlugins(netconf map[string]interface{}) ([]map[string]interface{}, error) {
+	list, ok := netconf["plugins"].([]interface{})
+	if !ok || len(list) == 0 {
+		return nil, fmt.Errorf("delegate field 'plugins' must be a non empty array")
+	}
+
+	plugins := make([]map[string]interface{}, 0, len(list))
+	for i, p := range list {
+		plugin, ok := p.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("delegate field 'plugins[%d]' must be an object", i)
+		}
+		if !isString(plugin["type"]) || plugin["type"].(string) == "" {
+			return nil, fmt.Errorf("delegate field 'plugins[%d]' must have a string field 'type'", i)
+		}
+		plugins = append(plugins, plugin)
+	}
+	return plugins, nil
+}
+
+// build the netconf of a plugin in a plugin chain, like libcni does, the
+// plugin inherits the name and cniVersion of the chain as well as the
+// fields injected by kactus, gets the runtimeConfig entries of the
+// capabilities it declares and the result of the previous plugin in the
+// chain as its prevResult
+func getChainPluginNetConf(netconf, plugin map[string]interface{}, prevResult types.Result) ([]byte, error) {
+	pluginConf := make(map[string]interface{}, len(plugin)+len(kactusChainFields)+3)
+	for k, v := range plugin {
+		pluginConf[k] = v
+	}
+	pluginConf["name"] = netconf["name"]
+	pluginConf["cniVersion"] = netconf["cniVersion"]
+	for _, field := range kactusChainFields {
+		if v, ok := netconf[field]; ok {
+			pluginConf[field] = v
+		}
+	}
+	delete(pluginConf, "runtimeConfig")
+	if runtimeConfig, ok := netconf["runtimeConfig"].(map[string]interface{}); ok {
+		if rc := getPluginRuntimeConfig(plugin, runtimeConfig); rc != nil {
+			pluginConf["runtimeConfig"] = rc
+		}
+	}
+
+	if err := setPrevResult(pluginConf, prevResult); err != nil {
+		return nil, err
+	}
+
+	return json.Marshal(pluginConf)
+}
+
+// set the prevResult of a netconf, converted to the netconf's cniVersion
+func setPrevResult(conf map[string]interface{}, prevResult types.Result) error {
+	if prevResult == nil {
+		return nil
+	}
+	if cniVersion, _ := conf["cniVersion"].(string); cniVersion != "" {
+		r, err := prevResult.GetAsVersion(cniVersion)
+		if err != nil {
+			return fmt.Errorf("failed to convert the prevResult to version %s: %v", cniVersion, err)
+		}
+		prevResult = r
+	}
+	conf["prevResult"] = prevResult
+	return nil
+}
+
+// serialize a delegate netconf along with its prevResult, the prevResult
+// of a plugin chain is set on each of its plugins instead
+func marshalDelegateNetConf(netconf map[string]interface{}, prevResult types.Result) ([]byte, error) {
+	if prevResult == nil || isPluginChain(netconf) {
+		return json.Marshal(netconf)
+	}
+
+	conf := make(map[string]interface{}, len(netconf)+1)
+	for k, v := range netconf {
+		conf[k] = v
+	}
+	if err := setPrevResult(conf, prevResult); err != nil {
+		return nil, err
+	}
+	return json.Marshal(conf)
+}
+
+// invoke the ADD of a delegate, a plugin chain gets invoked in order
+// where each plugin gets the result of the previous one; the ADD of each
+// plugin that succeeds is recorded in the transaction
+func delegatePluginsAdd(netconf map[string]interface{}, netconfBytes []byte, args *invoke.Args, tx *addTransaction) (types.Result, error) {
+	if !isPluginChain(netconf) {
+		pluginType := netconf["type"].(string)
+		result, err := execPlugin(pluginType, "ADD", netconfBytes, args)
+		if err != nil {
+			return nil, err
+		}
+		tx.recordPluginAdd(netconf, pluginType, netconfBytes, args, result)
+		return result, nil
+	}
+
+	plugins, err := getChainPlugins(netconf)
+	if err != nil {
+		return nil, err
+	}
+
+	var result types.Result
+	for i, plugin := range plugins {
+		pluginConfBytes, err := getChainPluginNetConf(netconf, plugin, result)
+		if err != nil {
+			return nil, err
+		}
+		kc.LogDebug("delegatePluginsAdd: will call ADD for plugin[%d]: %s, with: '%s'\n", i, plugin["type"], pluginConfBytes)
+		result, err = execPlugin(plugin["type"].(string), "ADD", pluginConfBytes, args)
+		if err != nil {
+			return nil, fmt.Errorf("plugin[%d] %q of the chain failed: %v", i, plugin["type"], err)
+		}
+		tx.recordPluginAdd(netconf, plugin["type"].(string), pluginConfBytes, args, result)
+	}
+	return result, nil
+}
+
+// invoke the DEL of a delegate, a plugin chain gets invoked in reverse
+// order where each plugin gets the result of the chain as its prevResult
+func delegatePluginsDel(netconf map[string]interface{}, netconfBytes []byte, args *invoke.Args, prevResult types.Result) error {
+	if !isPluginChain(netconf) {
+		_, err := execPlugin(netconf["type"].(string), "DEL", netconfBytes, args)
+		return err
+	}
+
+	plugins, err := getChainPlugins(netconf)
+	if err != nil {
+		return err
+	}
+
+	for i := len(plugins) - 1; i >= 0; i-- {
+		pluginConfBytes, err := getChainPluginNetConf(netconf, plugins[i], prevResult)
+		if err != nil {
+			return err
+		}
+		kc.LogDebug("delegatePluginsDel: will call DEL for plugin[%d]: %s, with: '%s'\n", i, plugins[i]["type"], pluginConfBytes)
+		if _, err := execPlugin(plugins[i]["type"].(string), "DEL", pluginConfBytes, args); err != nil {
+			return fmt.Errorf("plugin[%d] %q of the chain failed: %v", i, plugins[i]["type"], err)
+		}
+	}
+	return nil
+}
+
+// invoke the CHECK of a delegate, a plugin chain gets invoked in order
+// where each plugin gets the result of the chain as its prevResult
+func delegatePluginsCheck(netconf map[string]interface{}, netconfBytes []byte, args *invoke.Args, prevResult types.Result) error {
+	if !isPluginChain(netconf) {
+		_, err := execPlugin(netconf["type"].(string), "CHECK", netconfBytes, args)
+		return err
+	}
+
+	plugins, err := getChainPlugins(netconf)
+	if err != nil {
+		return err
+	}
+
+	for i, plugin := range plugins {
+		pluginConfBytes, err := getChainPluginNetConf(netconf, plugin, prevResult)
+		if err != nil {
+			return err
+		}
+		kc.LogDebug("delegatePluginsCheck: will call CHECK for plugin[%d]: %s, with: '%s'\n", i, plugin["type"], pluginConfBytes)
+		if _, err := execPlugin(plugin["type"].(string), "CHECK", pluginConfBytes, args); err != nil {
+			return fmt.Errorf("plugin[%d] %q of the chain failed: %v", i, plugin["type"], err)
+		}
+	}
+	return nil
+}
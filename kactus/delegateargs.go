@@ -0,0 +1,128 @@
+/*
+Copyright (c) 2021 Kaloom Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"path/filepath"
+	"strings"
+
+	kc "github.com/kaloom/kubernetes-common"
+
+	"golang.org/x/net/context"
+
+	"github.com/containernetworking/cni/pkg/invoke"
+	"github.com/containernetworking/cni/pkg/types"
+)
+
+// CNI_ARGS keys that are specific to a network attachment, the ones
+// supplied by the runtime are meant for the master plugin so they are
+// not passed through to the delegates of the auxiliary networks
+var perAttachmentArgs = map[string]bool{
+	"IP":                    true,
+	"GATEWAY":               true,
+	"MAC":                   true,
+	"CNI_IFMAC":             true,
+	"K8S_POD_IFMAC":         true,
+	"K8S_POD_IFNAME":        true,
+	"K8S_POD_LOWER_IFNAMES": true,
+}
+
+// parse CNI_ARGS into its key/value pairs, the pairs order is preserved
+func parseCNIArgs(args string) [][2]string {
+	var pairs [][2]string
+	for _, item := range strings.Split(args, ";") {
+		if item == "" {
+			continue
+		}
+		kv := strings.SplitN(item, "=", 2)
+		if len(kv) != 2 {
+			kc.LogDebug("parseCNIArgs: ignoring the invalid CNI_ARGS pair %q\n", item)
+			continue
+		}
+		pairs = append(pairs, [2]string{kv[0], kv[1]})
+	}
+	return pairs
+}
+
+// set the value of a CNI_ARGS key, replacing the value of an existing one
+func setCNIArg(pairs [][2]string, key, value string) [][2]string {
+	for i := range pairs {
+		if pairs[i][0] == key {
+			pairs[i][1] = value
+			return pairs
+		}
+	}
+	return append(pairs, [2]string{key, value})
+}
+
+// build the CNI_ARGS of a delegate off the ones kactus got invoked with,
+// the delegates of the auxiliary networks get the mac address requested
+// for their network attachment and any delegate gets the static addresses
+// requested for its network attachment
+func (cc *cniContext) getDelegateCNIArgs(masterPlugin bool, network networkConfig) [][2]string {
+	var pairs [][2]string
+	for _, pair := range parseCNIArgs(cc.args.Args) {
+		if !masterPlugin && perAttachmentArgs[pair[0]] {
+			continue
+		}
+		pairs = append(pairs, pair)
+	}
+	// needed so that delegates don't choke on the kubernetes args, see
+	// https://github.com/k8snetworkplumbingwg/whereabouts/blob/ebcf63f836d65f6d50e6ee2569997c5d5f081679/pkg/types/types.go#L63
+	pairs = setCNIArg(pairs, "IgnoreUnknown", "1")
+
+	if !masterPlugin && network.IfMAC != "" {
+		pairs = setCNIArg(pairs, "CNI_IFMAC", network.IfMAC)
+		pairs = setCNIArg(pairs, "MAC", network.IfMAC)
+	}
+	if len(network.IPs) > 0 {
+		pairs = setCNIArg(pairs, "IP", strings.Join(network.IPs, ","))
+		if network.Gateway != "" {
+			pairs = setCNIArg(pairs, "GATEWAY", network.Gateway)
+		}
+	}
+	return pairs
+}
+
+// the args of a delegate invocation, a delegate is invoked with its own
+// environment rather than the one of the kactus process
+func (cc *cniContext) getDelegateArgs(command, ifName string, pluginArgs [][2]string) *invoke.Args {
+	return &invoke.Args{
+		Command:     command,
+		ContainerID: cc.args.ContainerID,
+		NetNS:       cc.args.Netns,
+		PluginArgs:  pluginArgs,
+		IfName:      ifName,
+		Path:        cc.cniPath,
+	}
+}
+
+// execute a cni-plugin with the given args, the result is only returned
+// for ADD
+func execPlugin(pluginType, command string, netconf []byte, args *invoke.Args) (types.Result, error) {
+	pluginPath, err := invoke.FindInPath(pluginType, filepath.SplitList(args.Path))
+	if err != nil {
+		return nil, err
+	}
+
+	pluginArgs := *args
+	pluginArgs.Command = command
+	if command == "ADD" {
+		return invoke.ExecPluginWithResult(context.Background(), pluginPath, netconf, &pluginArgs, nil)
+	}
+	return nil, invoke.ExecPluginWithoutResult(context.Background(), pluginPath, netconf, &pluginArgs, nil)
+}
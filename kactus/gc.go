@@ -0,0 +1,454 @@
+/*
+Copyright (c) 2021 Kaloom Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	kc "github.com/kaloom/kubernetes-common"
+
+	"golang.org/x/net/context"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+
+	"github.com/containernetworking/cni/pkg/skel"
+	"github.com/containernetworking/cni/pkg/types"
+)
+
+// garbage collection of the delegates stores of sandboxes that are gone
+// without kactus getting a DEL for them (node crash, runtime bugs, etc),
+// it can be run by the "kactus gc" subcommand or periodically on ADD when
+// gcInterval is set in kactus config
+
+const (
+	defaultConfFile = "/etc/cni/net.d/05-kactus.conf"
+	defaultCNIPath  = "/opt/cni/bin"
+
+	// files under the kactus data directory used by the garbage
+	// collector, they are hidden to not be taken for a container's store
+	gcLockFile      = ".gc.lock"
+	gcTimestampFile = ".gc.timestamp"
+)
+
+// list the containers that have a delegates store in the data directory
+func listStoredContainers(dataDir string) ([]string, error) {
+	entries, err := ioutil.ReadDir(dataDir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to read the kactus data directory(%q): %v", dataDir, err)
+	}
+
+	var containerIDs []string
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || strings.HasPrefix(name, ".") ||
+			strings.HasSuffix(name, lockFileSuffix) ||
+			strings.HasSuffix(name, tmpFileSuffix) ||
+			strings.HasSuffix(name, corruptFileSuffix) {
+			continue
+		}
+		containerIDs = append(containerIDs, name)
+	}
+	return containerIDs, nil
+}
+
+// tells if the sandbox a delegates store belongs to is gone: either its
+// network namespace no longer exists or its Pod is no longer known by
+// the apiserver; an empty reason is returned if that can't be determined
+func isSandboxGone(sandbox sandboxInfo, k8sclient *kubernetes.Clientset) (bool, string, error) {
+	if sandbox.NetNS != "" {
+		if _, err := os.Stat(sandbox.NetNS); os.IsNotExist(err) {
+			return true, fmt.Sprintf("netns %s is gone", sandbox.NetNS), nil
+		}
+	}
+
+	if sandbox.PodName == "" || sandbox.PodNamespace == "" || k8sclient == nil {
+		if sandbox.NetNS != "" {
+			return false, fmt.Sprintf("netns %s exists", sandbox.NetNS), nil
+		}
+		return false, "", nil
+	}
+	pod, err := k8sclient.CoreV1().Pods(sandbox.PodNamespace).Get(context.TODO(), sandbox.PodName, metav1.GetOptions{})
+	if err != nil {
+		if apierrors.IsNotFound(err) {
+			return true, fmt.Sprintf("pod %s/%s is gone", sandbox.PodNamespace, sandbox.PodName), nil
+		}
+		return false, "", err
+	}
+	if sandbox.PodUID != "" && string(pod.UID) != sandbox.PodUID {
+		return true, fmt.Sprintf("pod %s/%s got recreated", sandbox.PodNamespace, sandbox.PodName), nil
+	}
+	return false, "pod is running", nil
+}
+
+// delete the delegates recorded for the container of an orphaned sandbox,
+// the delegates that failed to be deleted are kept in the store so that
+// a later garbage collection retries them
+func deleteOrphanedDelegates(nc *netConf, store *delegateStore, delegates []map[string]interface{}, cniPath string) error {
+	sandbox := store.sandbox
+	netns := sandbox.NetNS
+	if _, err := os.Stat(netns); err != nil {
+		netns = ""
+	}
+	ifName := sandbox.IfName
+	if ifName == "" {
+		ifName = "eth0"
+	}
+	cniArgs := fmt.Sprintf("IgnoreUnknown=1;K8S_POD_NAMESPACE=%s;K8S_POD_NAME=%s;K8S_POD_INFRA_CONTAINER_ID=%s",
+		sandbox.PodNamespace, sandbox.PodName, store.containerID)
+
+	cc := cniContext{
+		args: &skel.CmdArgs{
+			ContainerID: store.containerID,
+			Netns:       netns,
+			IfName:      ifName,
+			Args:        cniArgs,
+		},
+		cniPath: cniPath,
+		netconf: nc,
+		ifNames: store.ifNames,
+		store:   store,
+		cniArgs: &CNIArgs{
+			K8S_POD_NAMESPACE:          types.UnmarshallableString(sandbox.PodNamespace),
+			K8S_POD_NAME:               types.UnmarshallableString(sandbox.PodName),
+			K8S_POD_INFRA_CONTAINER_ID: types.UnmarshallableString(store.containerID),
+		},
+	}
+	var tornDown []map[string]interface{}
+	var failures []string
+	for _, delegate := range delegates {
+		if err := cc.delegateDel(ifName, delegate); err != nil {
+			failures = append(failures, fmt.Sprintf("network %s: %v", getDelegateName(delegate), err))
+			continue
+		}
+		tornDown = append(tornDown, delegate)
+	}
+	if err := store.save(removeDelegates(delegates, tornDown)); err != nil {
+		failures = append(failures, err.Error())
+	}
+
+	if len(failures) > 0 {
+		return fmt.Errorf("%s", strings.Join(failures, "; "))
+	}
+	return nil
+}
+
+// the cgroups of the processes running on the node, the pause process of a
+// sandbox runs in a cgroup named after the sandbox's container id (ex.
+// cri-containerd-<id>.scope, crio-<id>.scope, docker-<id>.scope)
+type processCgroups map[string]bool
+
+func loadProcessCgroups() (processCgroups, error) {
+	paths, err := filepath.Glob("/proc/[0-9]*/cgroup")
+	if err != nil {
+		return nil, fmt.Errorf("failed to list the processes: %v", err)
+	}
+	cgroups := make(processCgroups)
+	for _, path := range paths {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			// the process exited
+			continue
+		}
+		cgroups[string(data)] = true
+	}
+	return cgroups, nil
+}
+
+// tells if a process runs in the cgroup of a container
+func (pc processCgroups) hasContainer(containerID string) bool {
+	for cgroup := range pc {
+		if strings.Contains(cgroup, containerID) {
+			return true
+		}
+	}
+	return false
+}
+
+// tells if the sandbox of a delegates store recorded by a kactus that
+// predates the sandbox info is gone: no process runs in its cgroup anymore;
+// the processes kactus sees are only trusted to be the ones of the node
+// (i.e. it runs in the host pid namespace) when the ones of sandboxes
+// known to be alive are among them, an empty reason is returned otherwise
+func isLegacySandboxGone(containerID string, cgroups processCgroups, aliveContainerIDs []string) (bool, string) {
+	if cgroups.hasContainer(containerID) {
+		return false, "a process runs in its cgroup"
+	}
+	for _, id := range aliveContainerIDs {
+		if cgroups.hasContainer(id) {
+			return true, "no process runs in its cgroup"
+		}
+	}
+	return false, ""
+}
+
+// lock and load the delegates store of a container, a nil store is
+// returned when it has no delegates
+func loadStoredDelegates(dataDir, containerID string) (*delegateStore, []map[string]interface{}, error) {
+	store, err := lockDelegateStore(dataDir, containerID)
+	if err != nil {
+		return nil, nil, err
+	}
+	delegates, err := store.load()
+	if err != nil || len(delegates) == 0 {
+		store.Unlock()
+		return nil, nil, err
+	}
+	return store, delegates, nil
+}
+
+// report, and unless it's a dry run delete, the delegates of a store
+// according to the state of its sandbox
+func collectStore(nc *netConf, store *delegateStore, delegates []map[string]interface{}, gone bool, reason string, checkErr error, cniPath string, dryRun bool, report io.Writer) error {
+	containerID := store.containerID
+	switch {
+	case checkErr != nil:
+		fmt.Fprintf(report, "%s: skipped, failed to check its sandbox: %v\n", containerID, checkErr)
+	case !gone && reason == "":
+		fmt.Fprintf(report, "%s: skipped, its sandbox is unknown\n", containerID)
+	case !gone:
+		fmt.Fprintf(report, "%s: in use, %s\n", containerID, reason)
+	case dryRun:
+		fmt.Fprintf(report, "%s: orphaned, %s, would delete %d delegate(s)\n", containerID, reason, len(delegates))
+	default:
+		if err := deleteOrphanedDelegates(nc, store, delegates, cniPath); err != nil {
+			fmt.Fprintf(report, "%s: orphaned, %s, failed to delete its delegates: %v\n", containerID, reason, err)
+			return err
+		}
+		fmt.Fprintf(report, "%s: orphaned, %s, deleted %d delegate(s)\n", containerID, reason, len(delegates))
+	}
+	return nil
+}
+
+// collect the delegates stores of the sandboxes that are gone, the
+// skipped container is the one kactus got invoked for
+func collectGarbage(nc *netConf, k8sclient *kubernetes.Clientset, cniPath, skipContainerID string, dryRun bool, report io.Writer) error {
+	containerIDs, err := listStoredContainers(nc.CNIDir)
+	if err != nil {
+		return err
+	}
+
+	var errs []string
+	var legacy, alive []string
+	for _, containerID := range containerIDs {
+		if containerID == skipContainerID {
+			continue
+		}
+
+		store, delegates, err := loadStoredDelegates(nc.CNIDir, containerID)
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("container %s: %v", containerID, err))
+			continue
+		}
+		if store == nil {
+			continue
+		}
+		if store.sandbox == (sandboxInfo{}) {
+			// checked once the sandboxes that are alive are known
+			legacy = append(legacy, containerID)
+			store.Unlock()
+			continue
+		}
+
+		gone, reason, err := isSandboxGone(store.sandbox, k8sclient)
+		if err == nil && !gone && reason != "" {
+			alive = append(alive, containerID)
+		}
+		if err := collectStore(nc, store, delegates, gone, reason, err, cniPath, dryRun, report); err != nil {
+			errs = append(errs, fmt.Sprintf("container %s: %v", containerID, err))
+		}
+		store.Unlock()
+	}
+
+	if len(legacy) > 0 {
+		cgroups, cgroupsErr := loadProcessCgroups()
+		for _, containerID := range legacy {
+			store, delegates, err := loadStoredDelegates(nc.CNIDir, containerID)
+			if err != nil {
+				errs = append(errs, fmt.Sprintf("container %s: %v", containerID, err))
+				continue
+			}
+			if store == nil {
+				continue
+			}
+			var gone bool
+			var reason string
+			if cgroupsErr == nil {
+				gone, reason = isLegacySandboxGone(containerID, cgroups, alive)
+			}
+			if err := collectStore(nc, store, delegates, gone, reason, cgroupsErr, cniPath, dryRun, report); err != nil {
+				errs = append(errs, fmt.Sprintf("container %s: %v", containerID, err))
+			}
+			store.Unlock()
+		}
+	}
+
+	if !dryRun {
+		removed, err := newObjectCache(nc).prune()
+		if err != nil {
+			errs = append(errs, fmt.Sprintf("cache: %v", err))
+		} else if removed > 0 {
+			fmt.Fprintf(report, "cache: removed %d expired entries\n", removed)
+		}
+	}
+
+	if len(errs) > 0 {
+		return fmt.Errorf("garbage collection failed for %d container(s): %s", len(errs), strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// tells if the garbage collection didn't run during the last gcInterval
+func isGarbageCollectionDue(nc *netConf) bool {
+	interval, err := time.ParseDuration(nc.GCInterval)
+	if err != nil || interval <= 0 {
+		return false
+	}
+	fi, err := os.Stat(filepath.Join(nc.CNIDir, gcTimestampFile))
+	return err != nil || time.Since(fi.ModTime()) >= interval
+}
+
+// start, when it's due, the garbage collection in a "kactus gc -periodic"
+// process that kactus doesn't wait for, so that it doesn't add to the
+// latency of the ADD; the process gets kactus config on its stdin
+func startGarbageCollection(nc *netConf, conf []byte, cniPath, containerID string) {
+	if !isGarbageCollectionDue(nc) {
+		return
+	}
+	self, err := os.Executable()
+	if err != nil {
+		kc.LogError("startGarbageCollection: failed to find the kactus executable: %v\n", err)
+		return
+	}
+	r, w, err := os.Pipe()
+	if err != nil {
+		kc.LogError("startGarbageCollection: failed to create a pipe: %v\n", err)
+		return
+	}
+	defer w.Close()
+
+	cmd := exec.Command(self, "gc", "-periodic", "-conf", "-", "-cni-path", cniPath, "-skip", containerID)
+	// not attached to the stdout of kactus which the runtime reads until
+	// it's closed, nor to its session
+	cmd.Stdin = r
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+	err = cmd.Start()
+	r.Close()
+	if err != nil {
+		kc.LogError("startGarbageCollection: failed to start %s gc: %v\n", self, err)
+		return
+	}
+	if _, err := w.Write(conf); err != nil {
+		kc.LogError("startGarbageCollection: failed to pass kactus config to %s gc: %v\n", self, err)
+	}
+	cmd.Process.Release()
+}
+
+// run the garbage collection if it didn't run during the last gcInterval,
+// only one kactus instance on the node would run it at a time
+func maybeCollectGarbage(nc *netConf, k8sclient *kubernetes.Clientset, cniPath, containerID string) {
+	if !isGarbageCollectionDue(nc) {
+		return
+	}
+
+	timestampPath := filepath.Join(nc.CNIDir, gcTimestampFile)
+
+	lockPath := filepath.Join(nc.CNIDir, gcLockFile)
+	f, err := os.OpenFile(lockPath, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		kc.LogError("maybeCollectGarbage: failed to open the lock file(%q): %v\n", lockPath, err)
+		return
+	}
+	defer f.Close()
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		kc.LogDebug("maybeCollectGarbage: garbage collection already in progress\n")
+		return
+	}
+	defer syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+
+	if err := ioutil.WriteFile(timestampPath, []byte(time.Now().UTC().Format(time.RFC3339)), 0600); err != nil {
+		kc.LogError("maybeCollectGarbage: failed to write the timestamp file(%q): %v\n", timestampPath, err)
+		return
+	}
+
+	var report strings.Builder
+	if err := collectGarbage(nc, k8sclient, cniPath, containerID, false, &report); err != nil {
+		kc.LogError("maybeCollectGarbage: %v\n", err)
+	}
+	kc.LogInfo("maybeCollectGarbage: report:\n%s", report.String())
+}
+
+// the "kactus gc" subcommand, returns the process exit code
+func cmdGC(argv []string) int {
+	flags := flag.NewFlagSet("gc", flag.ContinueOnError)
+	confFile := flags.String("conf", defaultConfFile, "kactus cni-plugin config file, - to read it from stdin")
+	cniPath := flags.String("cni-path", defaultCNIPath, "directories where to look for the cni-plugins, used when CNI_PATH is not set")
+	dryRun := flags.Bool("dry-run", false, "only report the orphaned delegates, don't delete them")
+	periodic := flags.Bool("periodic", false, "only run if the garbage collection didn't run during the last gcInterval and log the report, as done on ADD")
+	skip := flags.String("skip", "", "the id of a container whose delegates are not collected")
+	if err := flags.Parse(argv); err != nil {
+		return 2
+	}
+
+	var data []byte
+	var err error
+	if *confFile == "-" {
+		data, err = ioutil.ReadAll(os.Stdin)
+	} else {
+		data, err = ioutil.ReadFile(*confFile)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to read %s: %v\n", *confFile, err)
+		return 1
+	}
+	nc, err := loadNetConf(data)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		return 1
+	}
+	if path := os.Getenv("CNI_PATH"); path != "" {
+		*cniPath = path
+	}
+
+	k8sclient, err := createK8sClient(nc)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to create a k8s client, only the netns of the sandboxes will be checked: %v\n", err)
+		k8sclient = nil
+	}
+
+	if *periodic {
+		maybeCollectGarbage(nc, k8sclient, *cniPath, *skip)
+		return 0
+	}
+	if err := collectGarbage(nc, k8sclient, *cniPath, *skip, *dryRun, os.Stdout); err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,125 @@
+/*
+Copyright (c) 2021 Kaloom Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// a cni-plugin that succeeds and records the commands it got invoked with,
+// its ADD result has no interfaces nor addresses
+const fakePluginScript = `#!/bin/sh
+echo "$CNI_COMMAND $CNI_IFNAME" >> "$(dirname "$0")/invocations"
+cat > /dev/null
+if [ "$CNI_COMMAND" = ADD ]; then
+	echo '{"cniVersion": "0.4.0"}'
+fi
+exit 0
+`
+
+func writeFakePlugin(t *testing.T, dir, pluginType string) {
+	t.Helper()
+	if err := ioutil.WriteFile(filepath.Join(dir, pluginType), []byte(fakePluginScript), 0755); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCollectGarbageOrphanedSandbox(t *testing.T) {
+	dataDir := t.TempDir()
+	cniPath := t.TempDir()
+	writeFakePlugin(t, cniPath, "fake")
+
+	store, err := lockDelegateStore(dataDir, "orphaned")
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.setSandbox(sandboxInfo{NetNS: filepath.Join(dataDir, "gone-netns"), IfName: "eth0"})
+	delegates := []map[string]interface{}{
+		{"cniVersion": "0.4.0", "name": "master", "type": "fake", "masterPlugin": true},
+		{"cniVersion": "0.4.0", "name": "aux", "type": "fake", "networkName": "aux"},
+	}
+	if err := store.save(delegates); err != nil {
+		t.Fatal(err)
+	}
+	store.Unlock()
+
+	nc := &netConf{CNIDir: dataDir, CacheTTL: "1m", CacheMaxStale: "1m"}
+	cacheDir := filepath.Join(dataDir, objectCacheDir)
+	if err := os.MkdirAll(cacheDir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	expired := filepath.Join(cacheDir, "expired")
+	if err := ioutil.WriteFile(expired, []byte("{}"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	old := time.Now().Add(-time.Hour)
+	if err := os.Chtimes(expired, old, old); err != nil {
+		t.Fatal(err)
+	}
+
+	var report strings.Builder
+	if err := collectGarbage(nc, nil, cniPath, "", false, &report); err != nil {
+		t.Fatalf("unexpected error: %v\nreport:\n%s", err, report.String())
+	}
+
+	if _, err := os.Stat(filepath.Join(dataDir, "orphaned")); !os.IsNotExist(err) {
+		t.Errorf("expected the store of the orphaned sandbox to be removed, got %v", err)
+	}
+	invocations, err := ioutil.ReadFile(filepath.Join(cniPath, "invocations"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.Count(string(invocations), "DEL "); got != 2 {
+		t.Errorf("expected 2 DEL invocations, got:\n%s", invocations)
+	}
+	if _, err := os.Stat(expired); !os.IsNotExist(err) {
+		t.Errorf("expected the expired cache entry to be removed, got %v", err)
+	}
+	if !strings.Contains(report.String(), "cache: removed 1 expired entries") {
+		t.Errorf("expected the report to list the removed cache entries, got:\n%s", report.String())
+	}
+}
+
+func TestCollectGarbageDryRun(t *testing.T) {
+	dataDir := t.TempDir()
+
+	store, err := lockDelegateStore(dataDir, "orphaned")
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.setSandbox(sandboxInfo{NetNS: filepath.Join(dataDir, "gone-netns")})
+	if err := store.save([]map[string]interface{}{{"type": "fake", "masterPlugin": true}}); err != nil {
+		t.Fatal(err)
+	}
+	store.Unlock()
+
+	var report strings.Builder
+	if err := collectGarbage(&netConf{CNIDir: dataDir}, nil, t.TempDir(), "", true, &report); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if !strings.Contains(report.String(), "orphaned: orphaned, netns") || !strings.Contains(report.String(), "would delete 1 delegate(s)") {
+		t.Errorf("unexpected report:\n%s", report.String())
+	}
+	if _, err := os.Stat(filepath.Join(dataDir, "orphaned")); err != nil {
+		t.Errorf("expected the store to be kept on a dry run, got %v", err)
+	}
+}
@@ -0,0 +1,57 @@
+/*
+Copyright (c) 2021 Kaloom Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+
+	kc "github.com/kaloom/kubernetes-common"
+
+	"github.com/containernetworking/cni/pkg/types"
+)
+
+// returns the result of a delegate that is already attached to the
+// sandbox with the same netconf, i.e. the ADD got retried (ex. the
+// podagent restarted); the attachment is verified with a CHECK and when
+// the CHECK fails it's torn down so that its ADD gets redone. A nil result
+// is returned if the delegate has to be added, an error if it failed its
+// CHECK and couldn't be torn down
+func (cc *cniContext) getAttachedResult(argIfName string, netconf map[string]interface{}) (types.Result, error) {
+	if cc.store == nil || !cc.store.isRecorded(netconf) {
+		return nil, nil
+	}
+	prevResult := cc.store.getResult(netconf)
+	if prevResult == nil {
+		return nil, nil
+	}
+
+	name := getDelegateName(netconf)
+	if !supportsCheck(netconf) {
+		kc.LogDebug("getAttachedResult: network %s is already attached but its cniVersion %v doesn't support CHECK, redoing its ADD\n", name, netconf["cniVersion"])
+		return nil, nil
+	}
+	if err := cc.delegateCheck(argIfName, netconf); err != nil {
+		kc.LogInfo("getAttachedResult: network %s is already attached but its CHECK failed, redoing it: %v\n", name, err)
+		if err := cc.delegateDel(argIfName, netconf); err != nil {
+			return nil, fmt.Errorf("network %s failed its CHECK and couldn't be deleted to redo its ADD: %v", name, err)
+		}
+		cc.tx.recordDeleted(netconf)
+		return nil, nil
+	}
+	kc.LogInfo("getAttachedResult: network %s is already attached, reusing its result\n", name)
+	return prevResult, nil
+}
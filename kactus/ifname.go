@@ -0,0 +1,161 @@
+/*
+Copyright (c) 2021 Kaloom Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	kc "github.com/kaloom/kubernetes-common"
+)
+
+const (
+	// the number of salted device names tried for a network attachment
+	// before giving up
+	maxIfNameSalt = 16
+
+	// the max. size of a linux device name (i.e. IFNAMSIZ - 1)
+	maxIfNameLength = 15
+)
+
+// the device name of a network attachment, with no salt it's the name
+// given by kc.GetNetworkIfname; a salted name is used when the former
+// collides with another device in the Pod
+func getSaltedNetworkIfname(networkName string, salt int) string {
+	if salt == 0 {
+		return kc.GetNetworkIfname(networkName)
+	}
+	return kc.GetNetworkIfname(fmt.Sprintf("%s#%d", networkName, salt))
+}
+
+// the device name of a delegate, the device name picked on ADD is the one
+// recorded in the delegates store; kactus versions that didn't record it
+// always used kc.GetNetworkIfname
+func (cc *cniContext) getIfName(argsIfName string, delegate map[string]interface{}) string {
+	if isMasterplugin(delegate) || !isString(delegate["networkName"]) {
+		return argsIfName
+	}
+	networkName := delegate["networkName"].(string)
+	if ifName, ok := cc.ifNames[networkName]; ok {
+		return ifName
+	}
+	return kc.GetNetworkIfname(networkName)
+}
+
+// validate a network device name requested for a network attachment,
+// the name must be a valid linux device name that isn't reserved for the
+// Pod's loopback and primary devices
+func validateIfName(ifName, argIfName string) error {
+	if len(ifName) > maxIfNameLength {
+		return fmt.Errorf("device name %q is longer than %d characters", ifName, maxIfNameLength)
+	}
+	if ifName == "." || ifName == ".." || strings.ContainsAny(ifName, "/: \t\n") {
+		return fmt.Errorf("device name %q is not a valid linux device name", ifName)
+	}
+	if ifName == "lo" || ifName == argIfName {
+		return fmt.Errorf("device name %q is reserved", ifName)
+	}
+	return nil
+}
+
+// pick the device names of the auxiliary network attachments that don't
+// have one yet; the requested device names are picked first so that the
+// other network attachments get a name, in the order of the delegates,
+// that doesn't collide with the Pod's primary device, with the devices of
+// the other network attachments nor with the devices found in the Pod's
+// netns
+func (cc *cniContext) allocateIfNames(argIfName string, networks []networkConfig, delegates []map[string]interface{}) error {
+	if cc.ifNames == nil {
+		cc.ifNames = make(map[string]string)
+	}
+
+	used := map[string]string{argIfName: ""}
+	for networkName, ifName := range cc.ifNames {
+		used[ifName] = networkName
+	}
+
+	var pending []int
+	for i, delegate := range delegates {
+		if isMasterplugin(delegate) || !isString(delegate["networkName"]) {
+			continue
+		}
+		networkName := delegate["networkName"].(string)
+		if ifName, ok := cc.ifNames[networkName]; ok {
+			if networks[i].Interface != "" && networks[i].Interface != ifName {
+				kc.LogInfo("allocateIfNames: network %s already has device name %s, ignoring the requested %s\n", networkName, ifName, networks[i].Interface)
+			}
+			continue
+		}
+		pending = append(pending, i)
+	}
+	if len(pending) == 0 {
+		return nil
+	}
+
+	var links map[string]bool
+	if cc.args.Netns != "" {
+		var err error
+		if links, err = getNetnsLinks(cc.args.Netns); err != nil {
+			kc.LogError("allocateIfNames: can't check the devices of the Pod's netns for collisions: %v\n", err)
+		}
+	}
+
+	for _, i := range pending {
+		ifName := networks[i].Interface
+		if ifName == "" {
+			continue
+		}
+		networkName := delegates[i]["networkName"].(string)
+		if owner, ok := used[ifName]; ok {
+			return fmt.Errorf("Kactus: the device name %s requested for network %s is already used by %q", ifName, networkName, owner)
+		}
+		if links[ifName] {
+			return fmt.Errorf("Kactus: the device name %s requested for network %s is already used by a device in the Pod's netns", ifName, networkName)
+		}
+		kc.LogDebug("allocateIfNames: network %s gets the requested device name %s\n", networkName, ifName)
+		cc.ifNames[networkName] = ifName
+		used[ifName] = networkName
+	}
+
+	for _, i := range pending {
+		if networks[i].Interface != "" {
+			continue
+		}
+		networkName := delegates[i]["networkName"].(string)
+		ifName := ""
+		for salt := 0; salt <= maxIfNameSalt; salt++ {
+			candidate := getSaltedNetworkIfname(networkName, salt)
+			if owner, ok := used[candidate]; ok {
+				kc.LogInfo("allocateIfNames: device name %s of network %s collides with the one of %q\n", candidate, networkName, owner)
+				continue
+			}
+			if links[candidate] {
+				kc.LogInfo("allocateIfNames: device name %s of network %s collides with a device in the Pod's netns\n", candidate, networkName)
+				continue
+			}
+			ifName = candidate
+			break
+		}
+		if ifName == "" {
+			return fmt.Errorf("Kactus: failed to pick a device name for network %s that doesn't collide with another device in the Pod", networkName)
+		}
+		kc.LogDebug("allocateIfNames: network %s gets device name %s\n", networkName, ifName)
+		cc.ifNames[networkName] = ifName
+		used[ifName] = networkName
+	}
+	return nil
+}
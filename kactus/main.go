@@ -23,37 +23,41 @@ then invoke them, e.g. flannel, knf or sriov plugin.
 package main
 
 import (
-	"bytes"
 	"encoding/json"
 	"fmt"
-	"io/ioutil"
 	"net"
+	"net/http"
 	"os"
-	"path/filepath"
 	"regexp"
 	"runtime/debug"
 	"strings"
+	"time"
 
 	kc "github.com/kaloom/kubernetes-common"
 
 	"golang.org/x/net/context"
 	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/clientcmd"
 
-	"github.com/containernetworking/cni/pkg/invoke"
 	"github.com/containernetworking/cni/pkg/skel"
 	"github.com/containernetworking/cni/pkg/types"
-	"github.com/containernetworking/cni/pkg/types/020"
+	types100 "github.com/containernetworking/cni/pkg/types/100"
 	"github.com/containernetworking/cni/pkg/version"
+
+	kaloomv1 "github.com/kaloom/kubernetes-kactus-cni-plugin/pkg/apis/kaloom/v1"
+	"github.com/kaloom/kubernetes-kactus-cni-plugin/pkg/client/clientset/versioned"
 )
 
 const (
 	defaultCNIDir     = "/var/lib/cni/kactus"
+	defaultNamespace  = "default"
 	crdGroupName      = "kaloom.com" // use our namespace to avoid colliding with somebody's else CRD that uses the same networks api extensions
 	resourceNameAnnot = "k8s.v1.cni.cncf.io/resourceName"
+	networksAnnot     = "networks"
 )
 
 var (
@@ -66,26 +70,53 @@ var (
 
 type netConf struct {
 	types.NetConf
-	CNIDir     string                   `json:"cniDir"`
-	Delegates  []map[string]interface{} `json:"delegates"`
-	Kubeconfig string                   `json:"kubeconfig"`
+	CNIDir               string                   `json:"cniDir"`
+	Delegates            []map[string]interface{} `json:"delegates"`
+	Kubeconfig           string                   `json:"kubeconfig"`
+	GCInterval           string                   `json:"gcInterval"`
+	CacheTTL             string                   `json:"cacheTTL"`
+	CacheMaxStale        string                   `json:"cacheMaxStale"`
+	APITimeout           string                   `json:"apiTimeout"`
+	APIRetries           *int                     `json:"apiRetries"`
+	APIRetryBackoff      string                   `json:"apiRetryBackoff"`
+	APIQPS               float32                  `json:"apiQPS"`
+	APIBurst             int                      `json:"apiBurst"`
+	DefaultNamespace     string                   `json:"defaultNamespace"`
+	AllowCrossNamespace  bool                     `json:"allowCrossNamespace"`
+	CRDLookupOrder       []string                 `json:"crdLookupOrder"`
+	MaxParallelDelegates int                      `json:"maxParallelDelegates"`
+	RuntimeConfig        map[string]interface{}   `json:"runtimeConfig,omitempty"`
 }
 
 type cniContext struct {
 	pod        *v1.Pod
+	args       *skel.CmdArgs
 	cniArgs    *CNIArgs
+	cniPath    string
 	auxNetOnly bool
 	k8sclient  *kubernetes.Clientset
+	netclient  versioned.Interface
+	netconf    *netConf
+	cache      *objectCache
+	ifNames    map[string]string
+	store      *delegateStore
+	tx         *addTransaction
 }
 
-// struct of k8s CRD network object
-type netObject struct {
-	metav1.TypeMeta   `json:",inline"`
-	metav1.ObjectMeta `json:"metadata,omitempty" description:"standard object metadata"`
-	Spec              struct {
-		Plugin string `json:"plugin"`
-		Config string `json:"config"`
-	} `json:"spec"`
+// the kaloom.com network object
+type netObject = kaloomv1.Network
+
+// networkConfig is an element of the networks Pod annotation, it extends
+// kc.NetworkConfig with the attributes only known to kactus
+type networkConfig struct {
+	kc.NetworkConfig
+	Interface string          `json:"interface,omitempty"` // optional parameter: the network device name in the Pod, picked by kactus if not specified
+	IPs       []string        `json:"ips,omitempty"`       // optional parameter: static addresses along with their prefix length, ex. 10.1.1.2/24
+	Gateway   string          `json:"gateway,omitempty"`   // optional parameter: the gateway of the static addresses
+	Bandwidth *bandwidthEntry `json:"bandwidth,omitempty"` // optional parameter: the bandwidth limits of the network device
+	Routes    []routeEntry    `json:"routes,omitempty"`    // optional parameter: routes through the network device, added to the ones of the Network CR
+	// optional parameter: a routing table dedicated to the network device, looked up by the traffic sourced from its addresses
+	RoutingTable int `json:"routingTable,omitempty"`
 }
 
 // CNIArgs is the valid CNI_ARGS used for Kubernetes
@@ -97,6 +128,8 @@ type CNIArgs struct {
 	K8S_POD_INFRA_CONTAINER_ID types.UnmarshallableString
 	K8S_POD_NETWORK            types.UnmarshallableString
 	K8S_POD_IFMAC              types.UnmarshallableString
+	K8S_POD_IFNAME             types.UnmarshallableString
+	K8S_POD_UID                types.UnmarshallableString
 }
 
 func logBuildDetails() {
@@ -123,86 +156,54 @@ func loadNetConf(bytes []byte) (*netConf, error) {
 		nc.CNIDir = defaultCNIDir
 	}
 
-	return nc, nil
-}
-
-func saveScratchNetConf(containerID, dataDir string, netconf []byte) error {
-	if err := os.MkdirAll(dataDir, 0700); err != nil {
-		return fmt.Errorf("failed to create the kactus data directory(%q): %v", dataDir, err)
-	}
-
-	path := filepath.Join(dataDir, containerID)
-	err := ioutil.WriteFile(path, netconf, 0600)
-	if err != nil {
-		return fmt.Errorf("failed to write container data in the path(%q): %v", path, err)
+	if nc.DefaultNamespace == "" {
+		nc.DefaultNamespace = defaultNamespace
 	}
 
-	return err
-}
-
-func getScratchNetConf(containerIDPath string) ([]byte, error) {
-	data, err := ioutil.ReadFile(containerIDPath)
-	if err != nil {
-		return nil, fmt.Errorf("failed to read container data in the path(%q): %v", containerIDPath, err)
+	if nc.GCInterval != "" {
+		if _, err := time.ParseDuration(nc.GCInterval); err != nil {
+			return nil, fmt.Errorf("invalid gcInterval %q: %v", nc.GCInterval, err)
+		}
 	}
 
-	return data, nil
-}
-
-func consumeScratchNetConf(containerID, dataDir string) ([]byte, error) {
-	path := filepath.Join(dataDir, containerID)
-	defer os.Remove(path)
-
-	return getScratchNetConf(path)
-}
-
-func sameNetworkName(netConf map[string]interface{}, netConfList []map[string]interface{}) bool {
-	for _, nc := range netConfList {
-		if nc["networkName"] == netConf["networkName"] {
-			return true
+	for field, value := range map[string]string{"cacheTTL": nc.CacheTTL, "cacheMaxStale": nc.CacheMaxStale} {
+		if value == "" {
+			continue
+		}
+		if d, err := time.ParseDuration(value); err != nil || d < 0 {
+			return nil, fmt.Errorf("invalid %s %q, it must be a positive duration (ex. 30s)", field, value)
 		}
 	}
-	return false
-}
 
-func mergeDelegates(containerID, dataDir string, delegates []map[string]interface{}) ([]map[string]interface{}, []map[string]interface{}) {
-	path := filepath.Join(dataDir, containerID)
-	netconfBytes, err := getScratchNetConf(path)
-	if err != nil {
-		return nil, delegates
+	if err := nc.validateAPIConfig(); err != nil {
+		return nil, err
 	}
-	var currentDelegates []map[string]interface{}
-	err = json.Unmarshal(netconfBytes, &currentDelegates)
-	if err != nil {
-		return nil, delegates
+
+	if nc.MaxParallelDelegates < 0 {
+		return nil, fmt.Errorf("invalid maxParallelDelegates %d, it can't be negative", nc.MaxParallelDelegates)
 	}
-	for _, d := range currentDelegates {
-		if d["networkName"] == nil || !isString(d["networkName"]) ||
-			!sameNetworkName(d, delegates) {
-			delegates = append(delegates, d)
+
+	// the delegates of kactus config are recorded by their key along with
+	// the ones of the network attachments
+	keys := make(map[string]bool)
+	for _, delegate := range nc.Delegates {
+		key := getDelegateKey(delegate)
+		if key != "" && keys[key] {
+			return nil, fmt.Errorf("the delegates in kactus config must have distinct names, %q is used more than once", strings.TrimPrefix(key, configDelegateKeyPrefix))
 		}
+		keys[key] = true
 	}
-	return currentDelegates, delegates
-}
 
-func saveDelegates(containerID, dataDir string, mergeExistingDelegates bool, delegates []map[string]interface{}) ([]map[string]interface{}, error) {
-	var currentDelegates []map[string]interface{}
-	if mergeExistingDelegates {
-		currentDelegates, delegates = mergeDelegates(containerID, dataDir, delegates)
+	if len(nc.CRDLookupOrder) == 0 {
+		nc.CRDLookupOrder = []string{crdGroupName}
 	}
-	if len(delegates) > 0 {
-		delegatesBytes, err := json.Marshal(delegates)
-		if err != nil {
-			return nil, fmt.Errorf("error serializing delegate netconf: %v", err)
+	for _, group := range nc.CRDLookupOrder {
+		if group != crdGroupName && group != npwgGroupName {
+			return nil, fmt.Errorf("unsupported crdLookupOrder group %q, supported groups are %s and %s", group, crdGroupName, npwgGroupName)
 		}
-
-		if err = saveScratchNetConf(containerID, dataDir, delegatesBytes); err != nil {
-			return nil, fmt.Errorf("error in saving the  delegates : %v", err)
-		}
-
-		return currentDelegates, nil
 	}
-	return currentDelegates, nil
+
+	return nc, nil
 }
 
 func isMasterplugin(netconf map[string]interface{}) bool {
@@ -229,6 +230,12 @@ func checkDelegate(netconf map[string]interface{}, masterpluginEnabled *bool) er
 		return fmt.Errorf("delegate field 'type' must be a string")
 	}
 
+	if isPluginChain(netconf) {
+		if _, err := getChainPlugins(netconf); err != nil {
+			return err
+		}
+	}
+
 	if isMasterplugin(netconf) {
 		if *masterpluginEnabled {
 			return fmt.Errorf("only one delegate can have 'masterPlugin'")
@@ -238,11 +245,6 @@ func checkDelegate(netconf map[string]interface{}, masterpluginEnabled *bool) er
 	return nil
 }
 
-// needed for IPAMs and wherabouts in particular see https://github.com/k8snetworkplumbingwg/whereabouts/blob/ebcf63f836d65f6d50e6ee2569997c5d5f081679/pkg/types/types.go#L63
-func getCNIArgsForDelegate(cniArgs *CNIArgs) string {
-	return fmt.Sprintf("IgnoreUnknown=1;K8S_POD_NAME=%s;K8S_POD_NAMESPACE=%s;K8S_POD_INFRA_CONTAINER_ID=%s", cniArgs.K8S_POD_NAME, cniArgs.K8S_POD_NAMESPACE, cniArgs.K8S_POD_INFRA_CONTAINER_ID)
-}
-
 func shouldIgnoreError(pluginType string, err error) bool {
 	if pluginType != "bridge" {
 		return false
@@ -254,107 +256,151 @@ func shouldIgnoreError(pluginType string, err error) bool {
 	return vethAlreadyExists.MatchString(err.Error())
 }
 
-func (cc *cniContext) delegateAdd(network kc.NetworkConfig, argif string, netconf map[string]interface{}) (error, types.Result) {
+func (cc *cniContext) delegateAdd(network networkConfig, argif string, netconf map[string]interface{}) (error, types.Result) {
 	kc.LogDebug("delegateAdd: network '%+v', argif '%s', netconf '%+v'\n", network, argif, netconf)
+	if result, err := cc.getAttachedResult(argif, netconf); err != nil {
+		kc.LogError("delegateAdd: %v\n", err)
+		return fmt.Errorf("Kactus: %v", err), nil
+	} else if result != nil {
+		cc.tx.recordAttached(netconf)
+		return nil, result
+	}
+
+	delegate := netconf
+	masterPlugin := isMasterplugin(netconf)
+	netconf = withRuntimeConfig(netconf, cc.getDelegateRuntimeConfig(masterPlugin, network))
+	netconf, pluginArgs := cc.withLowerLayers(argif, netconf, cc.getDelegateCNIArgs(masterPlugin, network))
 	netconfBytes, err := json.Marshal(netconf)
 	if err != nil {
 		return fmt.Errorf("Kactus: error serializing kactus delegate netconf: %v", err), nil
 	}
 
-	if !isMasterplugin(netconf) {
-		podif := kc.GetNetworkIfname(network.NetworkName)
+	ifName := cc.getIfName(argif, netconf)
+	args := cc.getDelegateArgs("ADD", ifName, pluginArgs)
+	kc.LogDebug("delegateAdd: will invoke ADD with a CNI_IFNAME set to: %s and CNI_ARGS set to: '%v' (master plugin: %t)\n", ifName, args.PluginArgs, masterPlugin)
 
-		if os.Setenv("CNI_IFNAME", podif) != nil {
-			return fmt.Errorf("Kactus: error in setting CNI_IFNAME"), nil
-		}
-		cniArgs := getCNIArgsForDelegate(cc.cniArgs)
-		if network.IfMAC != "" {
-			cniArgs = fmt.Sprintf("%s;CNI_IFMAC=%s;MAC=%s", cniArgs, network.IfMAC, network.IfMAC)
-			if os.Setenv("CNI_ARGS", cniArgs); err != nil {
-				return fmt.Errorf("Kactus: error in setting CNI_ARGS to %s", cniArgs), nil
-			}
-			kc.LogDebug("delegateAdd: will invoke.DelegateAdd with a CNI_IFNAME set to: %s and CNI_ARGS set to: '%s' (not a master plugin)\n", podif, cniArgs)
-		} else {
-			kc.LogDebug("delegateAdd: will invoke.DelegateAdd with a CNI_IFNAME set to: %s and CNI_ARGS set to: '%s' (not a master plugin)\n", podif, cniArgs)
-		}
-		if os.Setenv("CNI_ARGS", cniArgs); err != nil {
-			return fmt.Errorf("Kactus: error in setting CNI_ARGS to %s", cniArgs), nil
-		}
-	} else {
-		if os.Setenv("CNI_IFNAME", argif) != nil {
-			return fmt.Errorf("Kactus: error in setting CNI_IFNAME"), nil
-		}
-		kc.LogDebug("delegateAdd: will invoke.DelegateAdd with a CNI_IFNAME set to: %s' (not a master plugin)\n", argif)
-	}
 	delegatePluginType := netconf["type"].(string)
-	kc.LogDebug("delegateAdd: will call invoke.DelegateAdd for plugin: %s, with: '%s'\n", delegatePluginType, netconfBytes)
-	result, err := invoke.DelegateAdd(context.Background(), delegatePluginType, netconfBytes, nil)
+	kc.LogDebug("delegateAdd: will call ADD for plugin: %s, with: '%s'\n", delegatePluginType, netconfBytes)
+	result, err := delegatePluginsAdd(netconf, netconfBytes, args, cc.tx)
 	if err != nil {
 		if !shouldIgnoreError(delegatePluginType, err) {
-			kc.LogError("delegateAdd: invoke.DelegateAdd errored: %s: %v\n", delegatePluginType, err)
+			kc.LogError("delegateAdd: ADD errored: %s: %v\n", delegatePluginType, err)
 			return fmt.Errorf("Kactus: error in invoke Delegate add - %q: %v", delegatePluginType, err), nil
 		}
 
-		// podagent currently ignores the result so in this case it's fine
-		result = &types020.Result{}
-	}
-
-	// return result if the delegate is the master plugin or
-	// dynamically injected in a pod, for the latter the podagent
-	// would invoke kactus one network at a time
-	if !isMasterplugin(netconf) && !cc.auxNetOnly {
+		// the delegate was already invoked, it has no result to
+		// contribute to the merged result
+		cc.tx.recordAttached(delegate)
 		return nil, nil
 	}
+	if err := checkAssignedIPs(network, result); err != nil {
+		kc.LogError("delegateAdd: %v\n", err)
+		return fmt.Errorf("Kactus: %v", err), result
+	}
+	cc.tx.recordPodRouting(cc, delegate)
+	if err := cc.setPodRouting(ifName, delegate, result); err != nil {
+		kc.LogError("delegateAdd: %v\n", err)
+		return fmt.Errorf("Kactus: failed to program the routing of network %s: %v", getDelegateName(delegate), err), result
+	}
 
 	return nil, result
 }
 
 func (cc *cniContext) delegateDel(argIfName string, netconf map[string]interface{}) error {
 	kc.LogDebug("delegateDel: argIfname %s, netconf = '%v'\n", argIfName, netconf)
-	ifName := getIfName(argIfName, netconf)
-	netconfBytes, err := json.Marshal(netconf)
+	ifName := cc.getIfName(argIfName, netconf)
+	// the rules go first, while the device is still in the Pod
+	routingErr := cc.clearPodRouting(netconf)
+	if routingErr != nil {
+		kc.LogError("delegateDel: %v\n", routingErr)
+	}
+	prevResult := cc.getPrevResult(netconf)
+	netconf = withRuntimeConfig(netconf, cc.getDelegateRuntimeConfig(isMasterplugin(netconf), networkConfig{}))
+	netconf, pluginArgs := cc.withLowerLayers(argIfName, netconf, cc.getDelegateCNIArgs(isMasterplugin(netconf), networkConfig{}))
+	netconfBytes, err := marshalDelegateNetConf(netconf, prevResult)
 	if err != nil {
 		return fmt.Errorf("Kactus: error serializing kactus delegate netconf: %v", err)
 	}
 
-	if os.Setenv("CNI_IFNAME", ifName) != nil {
-		return fmt.Errorf("Kactus: error in setting CNI_IFNAME to %s", ifName)
-	}
-	cniArgs := getCNIArgsForDelegate(cc.cniArgs)
-	if os.Setenv("CNI_ARGS", cniArgs); err != nil {
-		return fmt.Errorf("Kactus: error in setting CNI_ARGS to %s", cniArgs)
-	}
-	kc.LogDebug("delegateDel: will invoke.DelegateDel with a CNI_IFNAME set to: %s\n", ifName)
+	args := cc.getDelegateArgs("DEL", ifName, pluginArgs)
+	kc.LogDebug("delegateDel: will invoke DEL with a CNI_IFNAME set to: %s\n", ifName)
 	delegatePluginType := netconf["type"].(string)
-	err = invoke.DelegateDel(context.Background(), delegatePluginType, netconfBytes, nil)
+	err = delegatePluginsDel(netconf, netconfBytes, args, prevResult)
 	if err != nil {
 		return fmt.Errorf("Kactus: error in invoke Delegate del - %q: %v", delegatePluginType, err)
 	}
+	if routingErr != nil {
+		return fmt.Errorf("Kactus: failed to clear the routing of network %s: %v", getDelegateName(netconf), routingErr)
+	}
 
 	return err
 }
 
-func (cc *cniContext) clearPlugins(idx int, argIfName string, delegates []map[string]interface{}) {
-	if os.Setenv("CNI_COMMAND", "DEL") != nil {
-		kc.LogError("failed to set CNI_COMMAND to DEL")
-		return
+// the ADD result recorded for a delegate, it's passed as the prevResult
+// of the delegate on DEL and CHECK like the CNI spec's result caching
+func (cc *cniContext) getPrevResult(netconf map[string]interface{}) types.Result {
+	if cc.store == nil {
+		return nil
 	}
+	return cc.store.getResult(netconf)
+}
 
-	kc.LogDebug("clearPlugins: idx=%d, argIfName=%s\n", idx, argIfName)
-	for i := 0; i <= idx; i++ {
-		cc.delegateDel(argIfName, delegates[i])
+// delegates using a cni spec. older than 0.4.0 don't know about CHECK
+func supportsCheck(netconf map[string]interface{}) bool {
+	cniVersion, ok := netconf["cniVersion"].(string)
+	if !ok || cniVersion == "" {
+		return false
 	}
+	gtet, err := version.GreaterThanOrEqualTo(cniVersion, "0.4.0")
+	if err != nil {
+		kc.LogDebug("supportsCheck: failed to parse cniVersion %s: %v\n", cniVersion, err)
+		return false
+	}
+	return gtet
 }
 
-func createK8sClient(kubeconfig string) (*kubernetes.Clientset, error) {
-	var err error
+// the network attachment name a delegate is associated with, used in
+// error messages
+func getDelegateName(netconf map[string]interface{}) string {
+	if isString(netconf["networkName"]) {
+		return netconf["networkName"].(string)
+	}
+	if isMasterplugin(netconf) {
+		return fmt.Sprintf("masterPlugin(%v)", netconf["type"])
+	}
+	return fmt.Sprintf("%v", netconf["type"])
+}
+
+func (cc *cniContext) delegateCheck(argIfName string, netconf map[string]interface{}) error {
+	kc.LogDebug("delegateCheck: argIfname %s, netconf = '%v'\n", argIfName, netconf)
+	ifName := cc.getIfName(argIfName, netconf)
+	prevResult := cc.getPrevResult(netconf)
+	netconf = withRuntimeConfig(netconf, cc.getDelegateRuntimeConfig(isMasterplugin(netconf), networkConfig{}))
+	netconf, pluginArgs := cc.withLowerLayers(argIfName, netconf, cc.getDelegateCNIArgs(isMasterplugin(netconf), networkConfig{}))
+	netconfBytes, err := marshalDelegateNetConf(netconf, prevResult)
+	if err != nil {
+		return fmt.Errorf("Kactus: error serializing kactus delegate netconf: %v", err)
+	}
+
+	args := cc.getDelegateArgs("CHECK", ifName, pluginArgs)
+	kc.LogDebug("delegateCheck: will invoke CHECK with a CNI_IFNAME set to: %s\n", ifName)
+	delegatePluginType := netconf["type"].(string)
+	err = delegatePluginsCheck(netconf, netconfBytes, args, prevResult)
+	if err != nil {
+		return fmt.Errorf("Kactus: error in invoke Delegate check - %q: %v", delegatePluginType, err)
+	}
 
-	cfg := &rest.Config{}
-	if kubeconfig != "" {
+	return nil
+}
+
+func getK8sConfig(nc *netConf) (*rest.Config, error) {
+	var cfg *rest.Config
+	var err error
+	if nc.Kubeconfig != "" {
 		// get a config from the provided kubeconfig file and use the current context
-		cfg, err = clientcmd.BuildConfigFromFlags("", kubeconfig)
+		cfg, err = clientcmd.BuildConfigFromFlags("", nc.Kubeconfig)
 		if err != nil {
-			return nil, fmt.Errorf("Kactus: failed to get context for the kubeconfig %v, refer Kactus README.md for the usage guide: %v", kubeconfig, err)
+			return nil, fmt.Errorf("Kactus: failed to get context for the kubeconfig %v, refer Kactus README.md for the usage guide: %v", nc.Kubeconfig, err)
 		}
 	} else {
 		// get a config from within the pod for in-cluster authentication
@@ -364,128 +410,305 @@ func createK8sClient(kubeconfig string) (*kubernetes.Clientset, error) {
 		}
 	}
 
+	nc.setAPIConfig(cfg)
+	return cfg, nil
+}
+
+func createK8sClient(nc *netConf) (*kubernetes.Clientset, error) {
+	cfg, err := getK8sConfig(nc)
+	if err != nil {
+		return nil, err
+	}
+
 	// creates the clientset
 	return kubernetes.NewForConfig(cfg)
 }
 
-func getPodNetworkAnnotation(client *kubernetes.Clientset, nameSpace, podName string) (string, *v1.Pod, error) {
-	pod, err := client.CoreV1().Pods(nameSpace).Get(context.TODO(), podName, metav1.GetOptions{})
+func createNetworkClient(nc *netConf) (*versioned.Clientset, error) {
+	cfg, err := getK8sConfig(nc)
 	if err != nil {
-		return "", nil, fmt.Errorf("Kactus: failed to fetch pod %s info off k8s apiserver: %v", podName, err)
+		return nil, err
 	}
 
-	return pod.Annotations["networks"], pod, nil
+	netclient, err := versioned.NewForConfig(cfg)
+	if err != nil {
+		return nil, fmt.Errorf("Kactus: failed to create the %s client: %v", crdGroupName, err)
+	}
+	return netclient, nil
 }
 
-// from the CRD networks's config, create a netconf for the delegate cni-plugin
-func getPluginNetConf(plugin, config, networkName, deviceID, resourceName string, primary bool) (string, error) {
-	var netconf bytes.Buffer
+// returns the client of the kaloom.com API, it's created on first use as
+// the Pods that only refer to NetworkAttachmentDefinitions don't need it
+func (cc *cniContext) getNetworkClient() (versioned.Interface, error) {
+	if cc.netclient == nil {
+		netclient, err := createNetworkClient(cc.netconf)
+		if err != nil {
+			return nil, err
+		}
+		cc.netclient = netclient
+	}
+	return cc.netclient, nil
+}
 
-	if plugin == "" || config == "" {
-		return "", fmt.Errorf("Kactus: plugin name/config can't be empty")
+// prefix the message of an error, an apiserver error keeps its status so
+// that it can still be told apart with apierrors.IsNotFound() and the like
+func prefixError(prefix string, err error) error {
+	if status, ok := err.(apierrors.APIStatus); ok {
+		s := status.Status()
+		s.Message = prefix + s.Message
+		return &apierrors.StatusError{ErrStatus: s}
 	}
+	return fmt.Errorf("%s%v", prefix, err)
+}
 
-	tmpconfig := []string{`{"type": "`, plugin, `","networkName": "`, networkName}
-	if deviceID != "" {
-		tmpconfig = append(tmpconfig, []string{`","deviceID": "`, deviceID, `","resourceName": "`, resourceName}...)
+// returns the networks annotation of a Pod along with its key, when the
+// Pod has both the kaloom.com and the k8s.v1.cni.cncf.io annotations the
+// one of the group that comes first in the CRD lookup order is used
+func getPodNetworkAnnotation(client *kubernetes.Clientset, cache *objectCache, nc *netConf, nameSpace, podName, podUID string) (string, string, *v1.Pod, error) {
+	// the Pod UID, when it's known, is part of the key so that a Pod that
+	// got recreated with the same name doesn't use the cached one
+	key := []string{"pods", nameSpace, podName}
+	if podUID != "" {
+		key = append(key, podUID)
+	}
+	podData, err := cache.get(key, func() ([]byte, error) {
+		var pod *v1.Pod
+		err := nc.retryAPI(fmt.Sprintf("getting pod %s/%s", nameSpace, podName), func() (err error) {
+			pod, err = client.CoreV1().Pods(nameSpace).Get(context.TODO(), podName, metav1.GetOptions{})
+			return err
+		})
+		if err != nil {
+			return nil, err
+		}
+		// only what kactus uses of the Pod is cached
+		return json.Marshal(&v1.Pod{ObjectMeta: metav1.ObjectMeta{
+			Name:        pod.Name,
+			Namespace:   pod.Namespace,
+			UID:         pod.UID,
+			Annotations: pod.Annotations,
+		}})
+	})
+	if err != nil {
+		return "", "", nil, fmt.Errorf("Kactus: failed to fetch pod %s info off k8s apiserver: %v", podName, err)
 	}
-	if primary {
-		tmpconfig = append(tmpconfig, []string{`","masterPlugin": true,`, config[strings.Index(config, "\""):len(config)]}...)
-	} else {
-		tmpconfig = append(tmpconfig, []string{`",`, config[strings.Index(config, "\""):len(config)]}...)
+	pod := &v1.Pod{}
+	if err := json.Unmarshal(podData, pod); err != nil {
+		return "", "", nil, fmt.Errorf("Kactus: failed to unmarshal pod %s info: %v", podName, err)
+	}
+
+	annotKey, annot := getNetworksAnnotation(pod, nc.CRDLookupOrder)
+	return annotKey, annot, pod, nil
+}
+
+// returns the key and value of the networks annotation of a Pod, the
+// annotations of the CRD groups are looked up in the configured order
+func getNetworksAnnotation(pod *v1.Pod, crdLookupOrder []string) (string, string) {
+	for _, group := range crdLookupOrder {
+		annotKey := networksAnnot
+		if group == npwgGroupName {
+			annotKey = npwgNetworksAnnot
+		}
+		if annot := pod.Annotations[annotKey]; annot != "" {
+			return annotKey, annot
+		}
 	}
+	return "", ""
+}
 
-	for _, c := range tmpconfig {
-		netconf.WriteString(c)
+// returns the namespaces, in lookup order, where the Network CR of a
+// Pod's network attachment is searched for: the namespace given in the
+// network annotation if any, otherwise the Pod's namespace then the
+// configured default namespace
+func (cc *cniContext) getNetworkNamespaces(podNet networkConfig) ([]string, error) {
+	podNamespace := string(cc.cniArgs.K8S_POD_NAMESPACE)
+	if podNet.Namespace != "" {
+		if podNet.Namespace != podNamespace && !cc.netconf.AllowCrossNamespace {
+			return nil, fmt.Errorf("network %s refers to namespace %s while the Pod is in namespace %s, cross-namespace references are not allowed (see allowCrossNamespace)", podNet.NetworkName, podNet.Namespace, podNamespace)
+		}
+		return []string{podNet.Namespace}, nil
 	}
 
-	return netconf.String(), nil
+	var namespaces []string
+	if podNamespace != "" {
+		namespaces = append(namespaces, podNamespace)
+	}
+	if cc.netconf.DefaultNamespace != podNamespace {
+		namespaces = append(namespaces, cc.netconf.DefaultNamespace)
+	}
+	return namespaces, nil
 }
 
-// call the CRD API extension for the crdGroupName and fetch the network configuration
-func (cc *cniContext) getDelegateNetConf(networkName string, resourceMap map[string]*ResourceInfo, primary bool) (string, map[string]*ResourceInfo, error) {
-	if networkName == "" {
-		return "", nil, fmt.Errorf("network name can't be empty")
+// unmarshal a network attachment object of the given CRD group into a
+// kaloom.com network object
+func unmarshalNetObject(group string, data []byte) (*netObject, error) {
+	if group == npwgGroupName {
+		nad := &netAttachDefObject{}
+		if err := json.Unmarshal(data, nad); err != nil {
+			return nil, err
+		}
+		return nad.toNetObject()
 	}
 
-	crd := fmt.Sprintf("/apis/%s/v1/namespaces/default/networks/%s", crdGroupName, networkName)
-	netObjectData, err := cc.k8sclient.ExtensionsV1beta1().RESTClient().Get().AbsPath(crd).DoRaw(context.TODO())
+	no := &netObject{}
+	if err := json.Unmarshal(data, no); err != nil {
+		return nil, err
+	}
+	return no, nil
+}
+
+// fetch a network attachment object of the given CRD group off the
+// apiserver, or off the cache, the errors of the apiserver are returned
+// as is
+func (cc *cniContext) fetchNetObject(group, namespace, name string) (*netObject, error) {
+	netObjectData, err := cc.cache.get([]string{group, namespace, name}, func() ([]byte, error) {
+		what := fmt.Sprintf("getting network %s/%s of group %s", namespace, name, group)
+		if group == npwgGroupName {
+			crd := fmt.Sprintf("/apis/%s/v1/namespaces/%s/network-attachment-definitions/%s", npwgGroupName, namespace, name)
+			var data []byte
+			err := cc.netconf.retryAPI(what, func() (err error) {
+				data, err = cc.k8sclient.Discovery().RESTClient().Get().AbsPath(crd).DoRaw(context.TODO())
+				return err
+			})
+			return data, err
+		}
+
+		netclient, err := cc.getNetworkClient()
+		if err != nil {
+			return nil, err
+		}
+		var no *netObject
+		err = cc.netconf.retryAPI(what, func() (err error) {
+			no, err = netclient.KaloomV1().Networks(namespace).Get(context.TODO(), name, metav1.GetOptions{})
+			return err
+		})
+		if err != nil {
+			return nil, err
+		}
+		return json.Marshal(no)
+	})
 	if err != nil {
-		return "", nil, fmt.Errorf("failed to get CRD, refer Kactus README.md for the usage guide: %v", err)
+		return nil, err
+	}
+
+	no, err := unmarshalNetObject(group, netObjectData)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unmarshal the netObject data for network %s/%s: %v", namespace, name, err)
+	}
+	return no, nil
+}
+
+// fetch the network object off the CRD groups, in the configured lookup
+// order; a network found in a namespace wins over the ones in the
+// namespaces that come after it. A network that is not found or that
+// kactus is not allowed to get is reported with the apiserver's status
+// (see apierrors.IsNotFound() and apierrors.IsForbidden())
+func (cc *cniContext) getNetObject(podNet networkConfig) (*netObject, error) {
+	namespaces, err := cc.getNetworkNamespaces(podNet)
+	if err != nil {
+		return nil, err
 	}
 
-	no := netObject{}
-	if err := json.Unmarshal(netObjectData, &no); err != nil {
-		return "", nil, fmt.Errorf("failed to unmarshal the netObject data for network %s: %v", networkName, err)
+	for _, namespace := range namespaces {
+		for _, group := range cc.netconf.CRDLookupOrder {
+			no, err := cc.fetchNetObject(group, namespace, podNet.NetworkName)
+			if err != nil {
+				if apierrors.IsNotFound(err) {
+					kc.LogDebug("getNetObject: network %s not found in namespace %s for group %s\n", podNet.NetworkName, namespace, group)
+					continue
+				}
+				return nil, prefixError("failed to get CRD, refer Kactus README.md for the usage guide: ", err)
+			}
+			kc.LogDebug("getNetObject: found network %s in namespace %s for group %s\n", podNet.NetworkName, namespace, group)
+			return no, nil
+		}
+	}
+
+	return nil, &apierrors.StatusError{ErrStatus: metav1.Status{
+		Status:  metav1.StatusFailure,
+		Code:    http.StatusNotFound,
+		Reason:  metav1.StatusReasonNotFound,
+		Message: fmt.Sprintf("network %s not found in namespace(s) %s", podNet.NetworkName, strings.Join(namespaces, ", ")),
+	}}
+}
+
+// fetch the network configuration of a Pod's network attachment and
+// create its delegate netconf
+func (cc *cniContext) getDelegateNetConf(podNet networkConfig, resourceMap map[string]*ResourceInfo, primary bool) (map[string]interface{}, map[string]*ResourceInfo, error) {
+	if podNet.NetworkName == "" {
+		return nil, nil, fmt.Errorf("network name can't be empty")
+	}
+
+	no, err := cc.getNetObject(podNet)
+	if err != nil {
+		return nil, nil, err
 	}
 
-	updatedResourceMap, deviceID, resourceName, err := cc.getResourceMap(&no, resourceMap)
+	updatedResourceMap, deviceID, resourceName, err := cc.getResourceMap(no, resourceMap)
 	if err != nil {
-		return "", nil, err
+		return nil, nil, err
 	}
 
-	nc, err := getPluginNetConf(no.Spec.Plugin, no.Spec.Config, networkName, deviceID, resourceName, primary)
+	nc, err := getPluginNetConf(no, deviceID, resourceName, primary)
 	if err != nil {
-		return "", nil, err
+		return nil, nil, err
+	}
+	crRouting := podRouting{Routes: no.Spec.Routes, RoutingTable: no.Spec.RoutingTable}
+	if routing := mergePodRouting(crRouting, podNet); routing != nil {
+		if err := routing.validate(primary); err != nil {
+			return nil, nil, fmt.Errorf("network %s: %v", podNet.NetworkName, err)
+		}
+		nc[podRoutingField] = routing
 	}
 
 	return nc, updatedResourceMap, nil
 }
 
-func (cc *cniContext) getNetworkConfig(networks []kc.NetworkConfig) (string, error) {
-	var netConf bytes.Buffer
+func (cc *cniContext) getNetworkConfig(networks []networkConfig) ([]map[string]interface{}, error) {
 	var resourceMap map[string]*ResourceInfo
 
-	netConf.WriteString("[")
-	for i, podNet := range networks {
-		if i != 0 {
-			netConf.WriteString(",")
-		}
-
+	delegates := make([]map[string]interface{}, 0, len(networks))
+	for _, podNet := range networks {
 		primary := false
 		if !cc.auxNetOnly && podNet.IsPrimary {
 			primary = true
 		}
 
-		nc, updatedResourceMap, err := cc.getDelegateNetConf(podNet.NetworkName, resourceMap, primary)
+		nc, updatedResourceMap, err := cc.getDelegateNetConf(podNet, resourceMap, primary)
 		if err != nil {
-			return "", fmt.Errorf("Kactus: failed getting the netplugin: %v", err)
+			return nil, prefixError("Kactus: failed getting the netplugin: ", err)
 		}
 		resourceMap = updatedResourceMap
-		netConf.WriteString(nc)
+		delegates = append(delegates, nc)
 	}
-	netConf.WriteString("]")
-
-	return netConf.String(), nil
-}
-
-func parseDelegatesNetConf(nc string) ([]map[string]interface{}, error) {
-	delegateNetconf := netConf{}
-
-	if nc == "" {
-		return nil, fmt.Errorf("Kactus: CRD network object data can't be empty")
+	setLowerLayers(networks, delegates)
+	if err := validateRoutingTables(delegates); err != nil {
+		return nil, err
 	}
 
-	dec := json.NewDecoder(strings.NewReader("{\"delegates\": " + nc + "}"))
-	dec.UseNumber()
-	if err := dec.Decode(&delegateNetconf); err != nil {
-		return nil, fmt.Errorf("Kactus: failed to load netconf: %v", err)
-	}
+	return delegates, nil
+}
 
-	if delegateNetconf.Delegates == nil {
-		return nil, fmt.Errorf("Kactus: \"delegates\" is must, refer Kactus README.md for the usage guide")
+// the networks of the delegates of kactus config, which set up the Pod's
+// primary network, they are empty since these delegates have no network
+// attachment; a Pod's networks are kept aligned with its delegates
+func getConfigNetworks(delegates []map[string]interface{}) []networkConfig {
+	networks := make([]networkConfig, len(delegates))
+	for i := range networks {
+		networks[i].IsPrimary = true
 	}
-
-	return delegateNetconf.Delegates, nil
+	return networks
 }
 
-func getPodNetworks(cniArgs *CNIArgs, k8sclient *kubernetes.Clientset) ([]kc.NetworkConfig, bool, *v1.Pod, error) {
+func getPodNetworks(cniArgs *CNIArgs, k8sclient *kubernetes.Clientset, cache *objectCache, nc *netConf) ([]networkConfig, bool, *v1.Pod, error) {
 	kc.LogDebug("getPodNetworks: cniArgs = '%+v'", cniArgs)
-	networks := []kc.NetworkConfig{}
+	networks := []networkConfig{}
 	if string(cniArgs.K8S_POD_NETWORK) != "" {
 		// this is a network that got dynamically added to a Pod, kactus was invoked by the podagant
-		podNet := kc.NetworkConfig{
-			NetworkName: string(cniArgs.K8S_POD_NETWORK),
+		podNet := networkConfig{
+			NetworkConfig: kc.NetworkConfig{
+				NetworkName: string(cniArgs.K8S_POD_NETWORK),
+			},
+			Interface: string(cniArgs.K8S_POD_IFNAME),
 		}
 		if mac := string(cniArgs.K8S_POD_IFMAC); mac != "" {
 			podNet.IfMAC = mac
@@ -494,35 +717,45 @@ func getPodNetworks(cniArgs *CNIArgs, k8sclient *kubernetes.Clientset) ([]kc.Net
 		return networks, true, nil, nil
 	}
 
-	netAnnot, pod, err := getPodNetworkAnnotation(k8sclient, string(cniArgs.K8S_POD_NAMESPACE), string(cniArgs.K8S_POD_NAME))
+	annotKey, netAnnot, pod, err := getPodNetworkAnnotation(k8sclient, cache, nc, string(cniArgs.K8S_POD_NAMESPACE), string(cniArgs.K8S_POD_NAME), string(cniArgs.K8S_POD_UID))
 	if err != nil {
 		return nil, false, nil, err
 	}
 
 	if netAnnot == "" {
-		networks = append(networks, kc.NetworkConfig{IsPrimary: true}) // fill this slot with an empty network
+		networks = append(networks, networkConfig{NetworkConfig: kc.NetworkConfig{IsPrimary: true}}) // fill this slot with an empty network
 		kc.LogDebug("getPodNetworks: len(netAnnot) = 0, nonet\n")
 		return networks, false, pod, nil
 	}
 
-	podNetworks := []kc.NetworkConfig{}
-	if err := json.Unmarshal([]byte(netAnnot), &podNetworks); err != nil {
-		err = fmt.Errorf("Kactus: failed to unmarshal pod network annotations '%q', err: %v", netAnnot, err)
+	podNetworks, err := parseNetworksAnnotation(annotKey, netAnnot)
+	if err != nil {
 		return nil, false, nil, err
 	}
 
 	return append(networks, podNetworks...), false, pod, nil
 }
 
-func (cc *cniContext) getDelegatesNetConf(networks []kc.NetworkConfig) ([]map[string]interface{}, error) {
-	kc.LogDebug("getDelegatesNetConf: networks: %v\n", networks)
-	networkConf, err := cc.getNetworkConfig(networks)
-	if err != nil {
-		return nil, err
+// parse the networks annotation of a Pod, either kactus's or the Network
+// Plumbing WG's one
+func parseNetworksAnnotation(annotKey, netAnnot string) ([]networkConfig, error) {
+	podNetworks := []networkConfig{}
+	if annotKey == npwgNetworksAnnot {
+		podNetworks, err := parseNetworkSelectionElements(netAnnot)
+		if err != nil {
+			return nil, fmt.Errorf("Kactus: %v", err)
+		}
+		return podNetworks, nil
+	}
+	if err := json.Unmarshal([]byte(netAnnot), &podNetworks); err != nil {
+		return nil, fmt.Errorf("Kactus: failed to unmarshal pod network annotations '%q', err: %v", netAnnot, err)
 	}
-	kc.LogDebug("getDelegatesNetConf: networkConf %+v\n", networkConf)
+	return podNetworks, nil
+}
 
-	delegatesNetConf, err := parseDelegatesNetConf(networkConf)
+func (cc *cniContext) getDelegatesNetConf(networks []networkConfig) ([]map[string]interface{}, error) {
+	kc.LogDebug("getDelegatesNetConf: networks: %v\n", networks)
+	delegatesNetConf, err := cc.getNetworkConfig(networks)
 	if err != nil {
 		return nil, err
 	}
@@ -531,10 +764,19 @@ func (cc *cniContext) getDelegatesNetConf(networks []kc.NetworkConfig) ([]map[st
 	return delegatesNetConf, nil
 }
 
-func validatePodNetworksConfig(networks []kc.NetworkConfig) (bool, error) {
+func validatePodNetworksConfig(networks []networkConfig, argIfName string) (bool, error) {
 	var havePrimary bool
 
+	ifNames := make(map[string]string)
+	names := make(map[string]bool)
 	for _, podNet := range networks {
+		// network attachments are identified by their name in a Pod (the
+		// podagent's K8S_POD_NETWORK, the device names, the delegates store)
+		// even when they are of different namespaces
+		if names[podNet.NetworkName] {
+			return false, fmt.Errorf("Network %s is listed more than once, network names must be unique in a Pod", podNet.NetworkName)
+		}
+		names[podNet.NetworkName] = true
 		if podNet.IsPrimary {
 			if !havePrimary {
 				havePrimary = true
@@ -547,18 +789,31 @@ func validatePodNetworksConfig(networks []kc.NetworkConfig) (bool, error) {
 				return false, fmt.Errorf("Network %s has an invalid mac address %s: %v", podNet.NetworkName, podNet.IfMAC, err)
 			}
 		}
+		if err := validateIPRequest(podNet); err != nil {
+			return false, fmt.Errorf("Network %s has an invalid ips request: %v", podNet.NetworkName, err)
+		}
+		if podNet.Bandwidth != nil {
+			if err := podNet.Bandwidth.validate(); err != nil {
+				return false, fmt.Errorf("Network %s has an invalid bandwidth: %v", podNet.NetworkName, err)
+			}
+		}
+		if podNet.Interface != "" {
+			if podNet.IsPrimary {
+				return false, fmt.Errorf("Network %s is primary, its device is %s and its interface can't be set", podNet.NetworkName, argIfName)
+			}
+			if err := validateIfName(podNet.Interface, argIfName); err != nil {
+				return false, fmt.Errorf("Network %s has an invalid interface: %v", podNet.NetworkName, err)
+			}
+			if other, ok := ifNames[podNet.Interface]; ok {
+				return false, fmt.Errorf("Networks %s and %s have the same interface %s", other, podNet.NetworkName, podNet.Interface)
+			}
+			ifNames[podNet.Interface] = podNet.NetworkName
+		}
 	}
-	return havePrimary, nil
-}
-
-func getIfName(argsIfName string, delegate map[string]interface{}) string {
-	var ifName string
-	if isMasterplugin(delegate) || !isString(delegate["networkName"]) {
-		ifName = argsIfName
-	} else {
-		ifName = kc.GetNetworkIfname(delegate["networkName"].(string))
+	if err := validateUpperLayers(networks); err != nil {
+		return false, err
 	}
-	return ifName
+	return havePrimary, nil
 }
 
 func (cc *cniContext) getResourceMap(no *netObject, resourceMap map[string]*ResourceInfo) (map[string]*ResourceInfo, string, string, error) {
@@ -612,18 +867,19 @@ func cmdAdd(args *skel.CmdArgs) error {
 	}
 	kc.LogDebug("cmdAdd: netconf %+v\n", nc)
 
-	k8sclient, err := createK8sClient(nc.Kubeconfig)
+	k8sclient, err := createK8sClient(nc)
 	if err != nil {
 		kc.LogError("cmdAdd: Err failed to create a k8s client: %v", err)
 		return err
 	}
-	networks, auxNetOnly, pod, err := getPodNetworks(&cniArgs, k8sclient)
+	cache := newObjectCache(nc)
+	networks, auxNetOnly, pod, err := getPodNetworks(&cniArgs, k8sclient, cache, nc)
 	if err != nil {
 		err = fmt.Errorf("Kactus: Err in getting k8s network from pod: %v", err)
 		kc.LogError("cmdAdd: %v\n", err)
 		return err
 	}
-	havePrimary, err := validatePodNetworksConfig(networks)
+	havePrimary, err := validatePodNetworksConfig(networks, args.IfName)
 	if err != nil {
 		err = fmt.Errorf("Kactus: Err in the Pod networks configuration: %v", err)
 		kc.LogError("cmdAdd: %v\n", err)
@@ -631,9 +887,13 @@ func cmdAdd(args *skel.CmdArgs) error {
 	}
 	cc := cniContext{
 		pod:        pod,
+		args:       args,
 		cniArgs:    &cniArgs,
+		cniPath:    os.Getenv("CNI_PATH"),
 		auxNetOnly: auxNetOnly,
 		k8sclient:  k8sclient,
+		netconf:    nc,
+		cache:      cache,
 	}
 	kc.LogDebug("cmdAdd: len(networks) = %d, networks = '%+v'", len(networks), networks)
 	if len(networks) > 0 && networks[0].NetworkName != "" {
@@ -644,11 +904,13 @@ func cmdAdd(args *skel.CmdArgs) error {
 		}
 		if !havePrimary && !auxNetOnly {
 			// Pod with networks annotations but with no primary network
+			networks = append(getConfigNetworks(nc.Delegates), networks...)
 			nc.Delegates = append(nc.Delegates, delegates...)
-			networks = append(append([]kc.NetworkConfig{}, kc.NetworkConfig{IsPrimary: true}), networks...)
 		} else {
 			nc.Delegates = delegates
 		}
+	} else {
+		networks = getConfigNetworks(nc.Delegates)
 	}
 
 	kc.LogDebug("cmdAdd: len(nc.Delegates) = %d, nc.Delegates = '%+v'", len(nc.Delegates), nc.Delegates)
@@ -660,50 +922,128 @@ func cmdAdd(args *skel.CmdArgs) error {
 			kc.LogError("cmdAdd: %v\n", err)
 			return err
 		}
-	}
-
-	var result, r types.Result
-	idx := -1
-	for i, delegate := range nc.Delegates {
-		idx = i
 		if nc.CNIVersion != "" {
 			delegate["cniVersion"] = nc.CNIVersion
 		}
-		err, r = cc.delegateAdd(networks[i], args.IfName, delegate)
-		if err != nil {
-			kc.LogError("cmdAdd: %v\n", err)
-			break
-		}
-		// among the list picks the result related to eth0
-		// interface or to an auxiliary interface in case
-		// kactus was invoked by the podagent
-		if result == nil {
-			result = r
-		}
 	}
 
+	store, err := lockDelegateStore(nc.CNIDir, args.ContainerID)
 	if err != nil {
-		cc.clearPlugins(idx, args.IfName, nc.Delegates)
+		err = fmt.Errorf("Kactus: Err in locking the delegates store: %v", err)
+		kc.LogError("cmdAdd: %v\n", err)
 		return err
 	}
-	// should not happens
-	if result == nil {
-		err = fmt.Errorf("Kactus: result is nil, this is not expected")
+	defer store.Unlock()
+	currentDelegates, err := store.load()
+	if err != nil {
+		err = fmt.Errorf("Kactus: Err in loading the delegates: %v", err)
+		kc.LogError("cmdAdd: %v\n", err)
+		return err
+	}
+	sandbox := sandboxInfo{
+		PodNamespace: string(cniArgs.K8S_POD_NAMESPACE),
+		PodName:      string(cniArgs.K8S_POD_NAME),
+		PodUID:       string(cniArgs.K8S_POD_UID),
+		NetNS:        args.Netns,
+	}
+	if pod != nil {
+		sandbox.PodUID = string(pod.UID)
+	}
+	if !auxNetOnly {
+		sandbox.IfName = args.IfName
+	}
+	store.setSandbox(sandbox)
+	cc.ifNames = store.ifNames
+	if err := cc.allocateIfNames(args.IfName, networks, nc.Delegates); err != nil {
+		kc.LogError("cmdAdd: %v\n", err)
+		return err
+	}
+	store.setIfNames(cc.ifNames)
+	// a delegate recorded with the same netconf along with its result is
+	// already attached, it only gets checked
+	cc.store = store
+	cc.tx = &addTransaction{}
+	store.dropStaleResults(nc.Delegates)
+	// record the delegates before invoking them, so that if kactus
+	// doesn't get to complete the ADD a following DEL would still tear
+	// them down
+	if err := store.save(mergeDelegates(currentDelegates, nc.Delegates)); err != nil {
+		err = fmt.Errorf("Kactus: Err in saving the delegates: %v", err)
 		kc.LogError("cmdAdd: %v\n", err)
-		cc.clearPlugins(idx, args.IfName, nc.Delegates)
 		return err
 	}
 
-	_, err = saveDelegates(args.ContainerID, nc.CNIDir, true, nc.Delegates)
+	var result types.Result
+	var statuses []*networkStatus
+	results, err := cc.addDelegates(networks, args.IfName, nc.Delegates)
 	if err != nil {
-		err = fmt.Errorf("Kactus: Err in saving the delegates: %v", err)
 		kc.LogError("cmdAdd: %v\n", err)
+	} else {
+		masterIdx := -1
+		for i, r := range results {
+			delegate := nc.Delegates[i]
+			if masterIdx < 0 && isMasterplugin(delegate) {
+				masterIdx = i
+			}
+			statuses = append(statuses, getNetworkStatus(getNetworkStatusName(nc.Name, delegate), cc.getIfName(args.IfName, delegate), networks[i].IfMAC, isMasterplugin(delegate), r))
+		}
+
+		// the result covers the interfaces of all the delegates, the
+		// ones of the master plugin come first
+		var merged *types100.Result
+		if merged, err = mergeResults(results, masterIdx); err == nil {
+			result, err = getResultAsVersion(merged, nc.CNIVersion)
+		}
+		if err != nil {
+			err = fmt.Errorf("Kactus: Err in merging the delegates results: %v", err)
+			kc.LogError("cmdAdd: %v\n", err)
+		}
+	}
+	if err != nil {
+		// undo what the ADD did, the delegates that are still attached
+		// (the ones of the previous ADDs this ADD didn't delete and the
+		// ones that fail to be rolled back) stay recorded so that a DEL
+		// tears them down
+		remaining, rerr := cc.tx.rollback(currentDelegates, nc.Delegates)
+		if rerr != nil {
+			kc.LogError("cmdAdd: %v\n", rerr)
+			err = fmt.Errorf("%v; %v", err, rerr)
+		}
+		if serr := store.save(remaining); serr != nil {
+			kc.LogError("cmdAdd: Err in saving the delegates: %v\n", serr)
+		}
 		return err
 	}
 
+	// record the results so that a retried ADD can reuse them
+	for i, r := range results {
+		if r == nil {
+			continue
+		}
+		if err := store.setResult(nc.Delegates[i], r); err != nil {
+			kc.LogError("cmdAdd: %v\n", err)
+		}
+	}
+	if err := store.save(mergeDelegates(currentDelegates, nc.Delegates)); err != nil {
+		kc.LogError("cmdAdd: Err in saving the delegates results: %v\n", err)
+	}
+
+	if err := cc.updateNetworkStatus(statuses, nil); err != nil {
+		// the network status is informational, not being able to
+		// publish it should not fail the Pod's networking
+		kc.LogError("cmdAdd: Err in updating the network-status annotation: %v\n", err)
+	}
+
 	kc.LogInfo("cmdAdd: delegated the creation of networks %+v\n", networks)
 
-	return result.Print()
+	store.Unlock()
+	if err := result.Print(); err != nil {
+		return err
+	}
+	if nc.GCInterval != "" {
+		startGarbageCollection(nc, args.StdinData, cc.cniPath, args.ContainerID)
+	}
+	return nil
 }
 
 func cmdDel(args *skel.CmdArgs) error {
@@ -724,84 +1064,154 @@ func cmdDel(args *skel.CmdArgs) error {
 	}
 	kc.LogDebug("cmdDel: netconf %+v\n", nc)
 
-	k8sclient, err := createK8sClient(nc.Kubeconfig)
-	if err != nil {
-		kc.LogError("cmdDel: Err failed to create a k8s client: %v", err)
-		return err
-	}
-	networks, auxNetOnly, pod, err := getPodNetworks(&cniArgs, k8sclient)
-	if err != nil {
-		podsNotFoundErr := fmt.Sprintf("pods \"%s\" not found", cniArgs.K8S_POD_NAME)
-		if strings.HasSuffix(err.Error(), podsNotFoundErr) {
-			kc.LogDebug("cmdDel: %v, assume the pod is gone\n", err)
-			return nil
-		}
-		err = fmt.Errorf("Kactus: Err in getting k8s network from pod: %v", err)
-		kc.LogError("cmdDel: %v\n", err)
-		return err
-	}
+	// DEL doesn't need the apiserver, the delegates to delete are the
+	// ones recorded on ADD: all of them on a sandbox's teardown and the
+	// one of the network the podagent asked for otherwise
 	cc := cniContext{
-		pod:        pod,
+		args:       args,
 		cniArgs:    &cniArgs,
-		auxNetOnly: auxNetOnly,
-		k8sclient:  k8sclient,
+		cniPath:    os.Getenv("CNI_PATH"),
+		auxNetOnly: string(cniArgs.K8S_POD_NETWORK) != "",
+		netconf:    nc,
 	}
-	kc.LogDebug("cmdDel: len(networks) = %d, networks = '%+v'", len(networks), networks)
 
-	netconfBytes, err := consumeScratchNetConf(args.ContainerID, nc.CNIDir)
+	store, err := lockDelegateStore(nc.CNIDir, args.ContainerID)
 	if err != nil {
-		kc.LogDebug("Can't read container netconf file: %v\n", err)
-		return nil
+		err = fmt.Errorf("Kactus: Err in locking the delegates store: %v", err)
+		kc.LogError("cmdDel: %v\n", err)
+		return err
 	}
+	defer store.Unlock()
 	// set delegates to nil to make sure there is not leftover from loadNetConf
 	nc.Delegates = nil
-	if err := json.Unmarshal(netconfBytes, &nc.Delegates); err != nil {
+	storedDelegates, err := store.load()
+	if err != nil {
 		err = fmt.Errorf("Kactus: failed to load netconf: %v", err)
 		kc.LogError("cmdDel: %v\n", err)
 		return err
 	}
+	if len(storedDelegates) == 0 {
+		kc.LogDebug("cmdDel: no delegates recorded for container %s\n", args.ContainerID)
+		return nil
+	}
+	nc.Delegates = storedDelegates
+	cc.ifNames = store.ifNames
+	cc.store = store
 
 	kc.LogDebug("cmdDel: nc.Delegates = '%+v'", nc.Delegates)
-	var delegateToDelete, remainingDelegates []map[string]interface{}
+	var delegateToDelete []map[string]interface{}
 	for _, delegate := range nc.Delegates {
-		if delegate["networkName"] == nil || !isString(delegate["networkName"]) {
-			if !auxNetOnly {
-				delegateToDelete = append(delegateToDelete, delegate)
-				// masterPlugin with no Pod networks annotation
-				continue
-			}
-		}
-		netFound := false
-		for _, network := range networks {
-			if delegate["networkName"] == network.NetworkName {
-				delegateToDelete = append(delegateToDelete, delegate)
-				netFound = true
-				break
-			}
-		}
-		if !netFound {
-			remainingDelegates = append(remainingDelegates, delegate)
+		if !cc.auxNetOnly || delegate["networkName"] == string(cniArgs.K8S_POD_NETWORK) {
+			delegateToDelete = append(delegateToDelete, delegate)
 		}
 	}
-	saveDelegates(args.ContainerID, nc.CNIDir, false, remainingDelegates)
 	nc.Delegates = delegateToDelete
 
-	for _, delegate := range nc.Delegates {
-		err := cc.delegateDel(args.IfName, delegate)
-		if err != nil {
-			kc.LogError("cmdDel: %v\n", err)
-			return err
-		}
+	// only forget about the delegates that got torn down
+	tornDown, err := cc.delDelegates(args.IfName, nc.Delegates)
+	if err != nil {
+		kc.LogError("cmdDel: %v\n", err)
 		result = err
 	}
+	var removed []string
+	for _, delegate := range tornDown {
+		removed = append(removed, getNetworkStatusName(nc.Name, delegate))
+	}
+	if err := store.save(removeDelegates(storedDelegates, tornDown)); err != nil {
+		err = fmt.Errorf("Kactus: Err in saving the delegates: %v", err)
+		kc.LogError("cmdDel: %v\n", err)
+		if result == nil {
+			result = err
+		}
+	}
+
+	// on a Pod's teardown the annotation goes away with it, only the
+	// networks dynamically removed by the podagent need to be unpublished
+	if cc.auxNetOnly && len(removed) > 0 {
+		if cc.k8sclient, err = createK8sClient(nc); err != nil {
+			kc.LogError("cmdDel: Err failed to create a k8s client: %v\n", err)
+		} else if err := cc.updateNetworkStatus(nil, removed); err != nil {
+			kc.LogError("cmdDel: Err in updating the network-status annotation: %v\n", err)
+		}
+	}
 
-	kc.LogInfo("cmdDel: delegated the deletion networks %+v\n", networks)
+	kc.LogInfo("cmdDel: delegated the deletion of networks %+v\n", removed)
 	return result
 }
 
 func cmdCheck(args *skel.CmdArgs) error {
-	// TODO: implement
-	return fmt.Errorf("not implemented")
+	logBuildDetails()
+	cniArgs := CNIArgs{}
+	err := types.LoadArgs(args.Args, &cniArgs)
+	if err != nil {
+		kc.LogError("cmdCheck: args: %v Err in loading args: %v\n", args.Args, err)
+		return err
+	}
+	kc.LogDebug("cmdCheck: args: %+v\n", string(args.StdinData[:]))
+	nc, err := loadNetConf(args.StdinData)
+	if err != nil {
+		kc.LogError("cmdCheck: args: %v Err in loading netconf: %v\n", string(args.StdinData[:]), err)
+		return fmt.Errorf("Kactus: Err in loading netconf: %v", err)
+	}
+	kc.LogDebug("cmdCheck: netconf %+v\n", nc)
+
+	store, err := lockDelegateStore(nc.CNIDir, args.ContainerID)
+	if err != nil {
+		err = fmt.Errorf("Kactus: Err in locking the delegates store: %v", err)
+		kc.LogError("cmdCheck: %v\n", err)
+		return err
+	}
+	defer store.Unlock()
+	nc.Delegates, err = store.load()
+	if err != nil {
+		err = fmt.Errorf("Kactus: failed to load netconf: %v", err)
+		kc.LogError("cmdCheck: %v\n", err)
+		return err
+	}
+	if len(nc.Delegates) == 0 {
+		err = fmt.Errorf("Kactus: no delegates recorded for container %s", args.ContainerID)
+		kc.LogError("cmdCheck: %v\n", err)
+		return err
+	}
+
+	cc := cniContext{
+		args:       args,
+		cniArgs:    &cniArgs,
+		cniPath:    os.Getenv("CNI_PATH"),
+		auxNetOnly: string(cniArgs.K8S_POD_NETWORK) != "",
+		netconf:    nc,
+		ifNames:    store.ifNames,
+		store:      store,
+	}
+	kc.LogDebug("cmdCheck: nc.Delegates = '%+v'", nc.Delegates)
+	var failures []string
+	for _, delegate := range nc.Delegates {
+		// when invoked by the podagent, only check the network it asked for
+		if cc.auxNetOnly && delegate["networkName"] != string(cniArgs.K8S_POD_NETWORK) {
+			continue
+		}
+		if !supportsCheck(delegate) {
+			kc.LogDebug("cmdCheck: skipping network %s, its cniVersion %v doesn't support CHECK\n", getDelegateName(delegate), delegate["cniVersion"])
+			continue
+		}
+		// a delegate without a recorded result can't be verified (ex. its
+		// ADD error got ignored or it was recorded by an older kactus)
+		if cc.getPrevResult(delegate) == nil {
+			kc.LogInfo("cmdCheck: skipping network %s, it has no recorded result to check against\n", getDelegateName(delegate))
+			continue
+		}
+		if err := cc.delegateCheck(args.IfName, delegate); err != nil {
+			kc.LogError("cmdCheck: network %s: %v\n", getDelegateName(delegate), err)
+			failures = append(failures, fmt.Sprintf("network %s: %v", getDelegateName(delegate), err))
+		}
+	}
+
+	if len(failures) > 0 {
+		return fmt.Errorf("Kactus: CHECK failed for %d network attachment(s): %s", len(failures), strings.Join(failures, "; "))
+	}
+
+	kc.LogInfo("cmdCheck: checked the networks of container %s\n", args.ContainerID)
+	return nil
 }
 
 func main() {
@@ -825,6 +1235,13 @@ func main() {
 		}
 	}()
 
+	if len(os.Args) > 1 && os.Args[1] == "gc" {
+		os.Exit(cmdGC(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "webhook" {
+		os.Exit(cmdWebhook(os.Args[2:]))
+	}
+
 	skel.PluginMain(cmdAdd, cmdCheck, cmdDel, version.All,
 		"meta-plugin that delegates to other CNI plugins")
 }
@@ -0,0 +1,130 @@
+/*
+Copyright (c) 2021 Kaloom Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"strings"
+	"testing"
+
+	kc "github.com/kaloom/kubernetes-common"
+)
+
+func TestLoadNetConfDelegates(t *testing.T) {
+	tests := []struct {
+		name string
+		conf string
+		err  string
+	}{
+		{
+			name: "master plugin and named delegates",
+			conf: `{"delegates": [{"type": "flannel", "masterPlugin": true}, {"name": "a", "type": "tuning"}, {"name": "b", "type": "tuning"}]}`,
+		},
+		{
+			name: "unnamed delegates of different types",
+			conf: `{"delegates": [{"type": "flannel", "masterPlugin": true}, {"type": "tuning"}, {"type": "portmap"}]}`,
+		},
+		{
+			name: "same name",
+			conf: `{"delegates": [{"name": "a", "type": "tuning"}, {"name": "a", "type": "portmap"}]}`,
+			err:  `"a" is used more than once`,
+		},
+		{
+			name: "unnamed delegates of the same type",
+			conf: `{"delegates": [{"type": "tuning"}, {"type": "tuning"}]}`,
+			err:  `"tuning" is used more than once`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := loadNetConf([]byte(tt.conf))
+			if tt.err == "" {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Fatalf("expected error %q, got %v", tt.err, err)
+			}
+		})
+	}
+}
+
+func TestValidatePodNetworksConfig(t *testing.T) {
+	network := func(namespace, name string, isPrimary bool) networkConfig {
+		return networkConfig{NetworkConfig: kc.NetworkConfig{Namespace: namespace, NetworkName: name, IsPrimary: isPrimary}}
+	}
+
+	tests := []struct {
+		name        string
+		networks    []networkConfig
+		havePrimary bool
+		err         string
+	}{
+		{
+			name:     "auxiliary networks",
+			networks: []networkConfig{network("", "a", false), network("ns", "b", false)},
+		},
+		{
+			name:        "primary network",
+			networks:    []networkConfig{network("", "a", true), network("", "b", false)},
+			havePrimary: true,
+		},
+		{
+			name:     "two primary networks",
+			networks: []networkConfig{network("", "a", true), network("", "b", true)},
+			err:      "Only one network can be primary",
+		},
+		{
+			name:     "same name in different namespaces",
+			networks: []networkConfig{network("ns1", "a", false), network("ns2", "a", false)},
+			err:      "Network a is listed more than once",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			havePrimary, err := validatePodNetworksConfig(tt.networks, "eth0")
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("expected error %q, got %v", tt.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if havePrimary != tt.havePrimary {
+				t.Errorf("expected havePrimary %t, got %t", tt.havePrimary, havePrimary)
+			}
+		})
+	}
+}
+
+func TestGetConfigNetworks(t *testing.T) {
+	delegates := []map[string]interface{}{{"type": "flannel", "masterPlugin": true}, {"type": "tuning"}}
+	networks := getConfigNetworks(delegates)
+	if len(networks) != len(delegates) {
+		t.Fatalf("expected %d networks, got %d", len(delegates), len(networks))
+	}
+	for i, network := range networks {
+		if network.NetworkName != "" || network.Interface != "" || !network.IsPrimary {
+			t.Errorf("expected network %d to be an empty primary network, got %+v", i, network)
+		}
+	}
+}
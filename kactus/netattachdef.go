@@ -0,0 +1,148 @@
+/*
+Copyright (c) 2021 Kaloom Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	kc "github.com/kaloom/kubernetes-common"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// support for the Network Plumbing WG's NetworkAttachmentDefinition CRD
+// and its networks Pod annotation, see
+// https://github.com/k8snetworkplumbingwg/multi-net-spec
+
+const (
+	npwgGroupName     = "k8s.cni.cncf.io"
+	npwgNetworksAnnot = "k8s.v1.cni.cncf.io/networks"
+)
+
+// struct of the k8s NetworkAttachmentDefinition object
+type netAttachDefObject struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty" description:"standard object metadata"`
+	Spec              struct {
+		Config string `json:"config"`
+	} `json:"spec"`
+}
+
+// networkSelectionElement is an element of the JSON form of the
+// k8s.v1.cni.cncf.io/networks Pod annotation
+type networkSelectionElement struct {
+	Name             string   `json:"name"`
+	Namespace        string   `json:"namespace,omitempty"`
+	InterfaceRequest string   `json:"interface,omitempty"`
+	MacRequest       string   `json:"mac,omitempty"`
+	IPRequest        []string `json:"ips,omitempty"`
+}
+
+// convert a NetworkAttachmentDefinition to a kaloom.com network object,
+// the plugin being the "type" of the JSON-formatted CNI configuration or
+// the type of the first plugin of a CNI configuration list
+func (nad *netAttachDefObject) toNetObject() (*netObject, error) {
+	if strings.TrimSpace(nad.Spec.Config) == "" {
+		return nil, fmt.Errorf("NetworkAttachmentDefinition %s/%s has an empty spec.config, referring to a CNI configuration file is not supported", nad.Namespace, nad.Name)
+	}
+
+	conf, err := parsePluginConfig(nad.Spec.Config)
+	if err != nil {
+		return nil, fmt.Errorf("NetworkAttachmentDefinition %s/%s has an invalid spec.config: %v", nad.Namespace, nad.Name, err)
+	}
+	pluginType, _ := conf["type"].(string)
+	if pluginType == "" && isPluginChain(conf) {
+		if plugins, err := getChainPlugins(conf); err == nil {
+			pluginType = plugins[0]["type"].(string)
+		}
+	}
+	if pluginType == "" {
+		return nil, fmt.Errorf("NetworkAttachmentDefinition %s/%s spec.config is missing the field 'type'", nad.Namespace, nad.Name)
+	}
+
+	no := &netObject{
+		TypeMeta:   nad.TypeMeta,
+		ObjectMeta: nad.ObjectMeta,
+	}
+	no.Spec.Plugin = pluginType
+	no.Spec.Config = nad.Spec.Config
+	return no, nil
+}
+
+// parse the short form of the k8s.v1.cni.cncf.io/networks annotation, a
+// comma separated list of [<namespace>/]<network name>[@<ifname>]
+func parseNetworkSelectionShortForm(annot string) ([]networkSelectionElement, error) {
+	var elements []networkSelectionElement
+	for _, item := range strings.Split(annot, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+
+		element := networkSelectionElement{}
+		name := item
+		if i := strings.LastIndex(name, "@"); i >= 0 {
+			element.InterfaceRequest = name[i+1:]
+			name = name[:i]
+		}
+		if i := strings.Index(name, "/"); i >= 0 {
+			element.Namespace = name[:i]
+			name = name[i+1:]
+		}
+		element.Name = name
+		if element.Name == "" || strings.Contains(element.Name, "/") {
+			return nil, fmt.Errorf("invalid network reference %q in the %s annotation", item, npwgNetworksAnnot)
+		}
+		elements = append(elements, element)
+	}
+	return elements, nil
+}
+
+// parse the k8s.v1.cni.cncf.io/networks annotation in either its JSON or
+// short form
+func parseNetworkSelectionElements(annot string) ([]networkConfig, error) {
+	var elements []networkSelectionElement
+	if strings.HasPrefix(strings.TrimSpace(annot), "[") {
+		if err := json.Unmarshal([]byte(annot), &elements); err != nil {
+			return nil, fmt.Errorf("failed to unmarshal the %s annotation '%q': %v", npwgNetworksAnnot, annot, err)
+		}
+	} else {
+		var err error
+		if elements, err = parseNetworkSelectionShortForm(annot); err != nil {
+			return nil, err
+		}
+	}
+
+	networks := []networkConfig{}
+	for _, element := range elements {
+		if element.Name == "" {
+			return nil, fmt.Errorf("a network in the %s annotation is missing its name", npwgNetworksAnnot)
+		}
+		networks = append(networks, networkConfig{
+			NetworkConfig: kc.NetworkConfig{
+				NetworkName: element.Name,
+				Namespace:   element.Namespace,
+				IfMAC:       element.MacRequest,
+			},
+			Interface: element.InterfaceRequest,
+			IPs:       element.IPRequest,
+		})
+	}
+	return networks, nil
+}
@@ -0,0 +1,198 @@
+/*
+Copyright (c) 2021 Kaloom Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	kc "github.com/kaloom/kubernetes-common"
+)
+
+func TestParseNetworkSelectionShortForm(t *testing.T) {
+	tests := []struct {
+		name     string
+		annot    string
+		elements []networkSelectionElement
+		err      string
+	}{
+		{
+			name:     "name",
+			annot:    "net1",
+			elements: []networkSelectionElement{{Name: "net1"}},
+		},
+		{
+			name:  "namespace, name and device name",
+			annot: "ns1/net1@eth1, net2@eth2,ns3/net3",
+			elements: []networkSelectionElement{
+				{Namespace: "ns1", Name: "net1", InterfaceRequest: "eth1"},
+				{Name: "net2", InterfaceRequest: "eth2"},
+				{Namespace: "ns3", Name: "net3"},
+			},
+		},
+		{
+			name:     "the device name is after the last @",
+			annot:    "ns1/net@1@eth1",
+			elements: []networkSelectionElement{{Namespace: "ns1", Name: "net@1", InterfaceRequest: "eth1"}},
+		},
+		{
+			name:     "empty items are skipped",
+			annot:    " net1,, ,net2 ",
+			elements: []networkSelectionElement{{Name: "net1"}, {Name: "net2"}},
+		},
+		{
+			name:  "empty",
+			annot: "",
+		},
+		{
+			name:  "no name",
+			annot: "ns1/@eth1",
+			err:   `invalid network reference "ns1/@eth1"`,
+		},
+		{
+			name:  "too many namespaces",
+			annot: "net1,ns1/ns2/net2",
+			err:   `invalid network reference "ns1/ns2/net2"`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			elements, err := parseNetworkSelectionShortForm(tt.annot)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("expected error %q, got %v", tt.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(elements, tt.elements) {
+				t.Errorf("expected %+v, got %+v", tt.elements, elements)
+			}
+		})
+	}
+}
+
+func TestParseNetworkSelectionElements(t *testing.T) {
+	tests := []struct {
+		name     string
+		annot    string
+		networks []networkConfig
+		err      string
+	}{
+		{
+			name:  "short form",
+			annot: "ns1/net1@eth1",
+			networks: []networkConfig{
+				{NetworkConfig: kc.NetworkConfig{NetworkName: "net1", Namespace: "ns1"}, Interface: "eth1"},
+			},
+		},
+		{
+			name:  "JSON form",
+			annot: ` [{"name": "net1", "namespace": "ns1", "interface": "eth1", "mac": "02:00:00:00:00:01", "ips": ["10.1.1.2/24"]}]`,
+			networks: []networkConfig{
+				{
+					NetworkConfig: kc.NetworkConfig{NetworkName: "net1", Namespace: "ns1", IfMAC: "02:00:00:00:00:01"},
+					Interface:     "eth1",
+					IPs:           []string{"10.1.1.2/24"},
+				},
+			},
+		},
+		{
+			name:  "JSON form without a name",
+			annot: `[{"namespace": "ns1"}]`,
+			err:   "missing its name",
+		},
+		{
+			name:  "invalid JSON form",
+			annot: `[{"name": 1}]`,
+			err:   "failed to unmarshal",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			networks, err := parseNetworkSelectionElements(tt.annot)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("expected error %q, got %v", tt.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(networks, tt.networks) {
+				t.Errorf("expected %+v, got %+v", tt.networks, networks)
+			}
+		})
+	}
+}
+
+func TestNetAttachDefToNetObject(t *testing.T) {
+	tests := []struct {
+		name   string
+		config string
+		plugin string
+		err    string
+	}{
+		{
+			name:   "plugin",
+			config: `{"cniVersion": "0.4.0", "type": "macvlan"}`,
+			plugin: "macvlan",
+		},
+		{
+			name:   "plugin chain",
+			config: `{"cniVersion": "0.4.0", "plugins": [{"type": "bridge"}, {"type": "portmap"}]}`,
+			plugin: "bridge",
+		},
+		{
+			name:   "no config",
+			config: " ",
+			err:    "empty spec.config",
+		},
+		{
+			name:   "no type",
+			config: `{"cniVersion": "0.4.0"}`,
+			err:    "missing the field 'type'",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			nad := &netAttachDefObject{}
+			nad.Namespace, nad.Name = "ns", "nad"
+			nad.Spec.Config = tt.config
+			no, err := nad.toNetObject()
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("expected error %q, got %v", tt.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if no.Spec.Plugin != tt.plugin || no.Spec.Config != tt.config || no.Namespace != "ns" || no.Name != "nad" {
+				t.Errorf("unexpected network object %+v", no)
+			}
+		})
+	}
+}
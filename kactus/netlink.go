@@ -0,0 +1,220 @@
+/*
+Copyright (c) 2021 Kaloom Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"syscall"
+	"unsafe"
+
+	"golang.org/x/sys/unix"
+)
+
+// a minimal rtnetlink client to add routes and to add and delete policy
+// routing rules in the netns of the calling thread
+
+const (
+	// the attributes of a fib rule (linux/fib_rules.h)
+	fraSrc   = 2
+	fraTable = 15
+
+	// the action of a fib rule that looks up a routing table
+	frActToTbl = 1
+)
+
+var nativeEndian binary.ByteOrder = func() binary.ByteOrder {
+	x := uint16(1)
+	if *(*byte)(unsafe.Pointer(&x)) == 1 {
+		return binary.LittleEndian
+	}
+	return binary.BigEndian
+}()
+
+type nlAttr struct {
+	attrType uint16
+	data     []byte
+}
+
+func nlAttrUint32(attrType uint16, v uint32) nlAttr {
+	data := make([]byte, 4)
+	nativeEndian.PutUint32(data, v)
+	return nlAttr{attrType: attrType, data: data}
+}
+
+// the address family and the bytes of an ip address as rtnetlink expects
+func ipFamily(ip net.IP) (uint8, []byte) {
+	if ip4 := ip.To4(); ip4 != nil {
+		return unix.AF_INET, ip4
+	}
+	return unix.AF_INET6, ip.To16()
+}
+
+type netlinkConn struct {
+	fd  int
+	seq uint32
+}
+
+func openNetlink() (*netlinkConn, error) {
+	fd, err := unix.Socket(unix.AF_NETLINK, unix.SOCK_RAW|unix.SOCK_CLOEXEC, unix.NETLINK_ROUTE)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open a netlink socket: %v", err)
+	}
+	if err := unix.Bind(fd, &unix.SockaddrNetlink{Family: unix.AF_NETLINK}); err != nil {
+		unix.Close(fd)
+		return nil, fmt.Errorf("failed to bind the netlink socket: %v", err)
+	}
+	return &netlinkConn{fd: fd}, nil
+}
+
+func (c *netlinkConn) Close() error {
+	return unix.Close(c.fd)
+}
+
+// send a rtnetlink request made of a rtmsg (a fib rule header has the same
+// layout) and its attributes, then wait for its acknowledgment; the error
+// returned by the kernel is returned as a syscall.Errno
+func (c *netlinkConn) request(msgType, flags uint16, rtm unix.RtMsg, attrs ...nlAttr) error {
+	c.seq++
+	msg := make([]byte, unix.SizeofNlMsghdr+unix.SizeofRtMsg)
+	msg[unix.SizeofNlMsghdr] = rtm.Family
+	msg[unix.SizeofNlMsghdr+1] = rtm.Dst_len
+	msg[unix.SizeofNlMsghdr+2] = rtm.Src_len
+	msg[unix.SizeofNlMsghdr+3] = rtm.Tos
+	msg[unix.SizeofNlMsghdr+4] = rtm.Table
+	msg[unix.SizeofNlMsghdr+5] = rtm.Protocol
+	msg[unix.SizeofNlMsghdr+6] = rtm.Scope
+	msg[unix.SizeofNlMsghdr+7] = rtm.Type
+	nativeEndian.PutUint32(msg[unix.SizeofNlMsghdr+8:], rtm.Flags)
+	for _, attr := range attrs {
+		hdr := make([]byte, unix.SizeofRtAttr)
+		nativeEndian.PutUint16(hdr, uint16(unix.SizeofRtAttr+len(attr.data)))
+		nativeEndian.PutUint16(hdr[2:], attr.attrType)
+		msg = append(msg, hdr...)
+		msg = append(msg, attr.data...)
+		for len(msg)%4 != 0 {
+			msg = append(msg, 0)
+		}
+	}
+	nativeEndian.PutUint32(msg, uint32(len(msg)))
+	nativeEndian.PutUint16(msg[4:], msgType)
+	nativeEndian.PutUint16(msg[6:], flags|unix.NLM_F_REQUEST|unix.NLM_F_ACK)
+	nativeEndian.PutUint32(msg[8:], c.seq)
+
+	if err := unix.Sendto(c.fd, msg, 0, &unix.SockaddrNetlink{Family: unix.AF_NETLINK}); err != nil {
+		return fmt.Errorf("failed to send the netlink request: %v", err)
+	}
+
+	buf := make([]byte, unix.Getpagesize())
+	for {
+		n, _, err := unix.Recvfrom(c.fd, buf, 0)
+		if err != nil {
+			return fmt.Errorf("failed to receive the netlink response: %v", err)
+		}
+		msgs, err := syscall.ParseNetlinkMessage(buf[:n])
+		if err != nil {
+			return fmt.Errorf("failed to parse the netlink response: %v", err)
+		}
+		for _, m := range msgs {
+			if m.Header.Seq != c.seq || m.Header.Type != unix.NLMSG_ERROR {
+				continue
+			}
+			if len(m.Data) < 4 {
+				return fmt.Errorf("truncated netlink error message")
+			}
+			if errno := int32(nativeEndian.Uint32(m.Data)); errno != 0 {
+				return syscall.Errno(-errno)
+			}
+			return nil
+		}
+	}
+}
+
+// add or replace a route through a device, the route is on link when it
+// has no gateway
+func (c *netlinkConn) replaceRoute(dst *net.IPNet, gw, src net.IP, ifIndex int, table uint32) error {
+	family, dstIP := ipFamily(dst.IP)
+	ones, _ := dst.Mask.Size()
+	rtm := unix.RtMsg{
+		Family:   family,
+		Dst_len:  uint8(ones),
+		Protocol: unix.RTPROT_STATIC,
+		Scope:    unix.RT_SCOPE_UNIVERSE,
+		Type:     unix.RTN_UNICAST,
+	}
+	if table < 256 {
+		rtm.Table = uint8(table)
+	}
+	attrs := []nlAttr{
+		nlAttrUint32(unix.RTA_TABLE, table),
+		nlAttrUint32(unix.RTA_OIF, uint32(ifIndex)),
+	}
+	if ones > 0 {
+		attrs = append(attrs, nlAttr{attrType: unix.RTA_DST, data: dstIP})
+	}
+	if gw != nil {
+		_, gwIP := ipFamily(gw)
+		attrs = append(attrs, nlAttr{attrType: unix.RTA_GATEWAY, data: gwIP})
+	} else {
+		rtm.Scope = unix.RT_SCOPE_LINK
+	}
+	if src != nil {
+		_, srcIP := ipFamily(src)
+		attrs = append(attrs, nlAttr{attrType: unix.RTA_PREFSRC, data: srcIP})
+	}
+	return c.request(unix.RTM_NEWROUTE, unix.NLM_F_CREATE|unix.NLM_F_REPLACE, rtm, attrs...)
+}
+
+// add a rule that looks up a routing table for the traffic sourced from an
+// ip address, an existing rule is left as is
+func (c *netlinkConn) addSourceRule(src net.IP, table uint32) error {
+	family, srcIP := ipFamily(src)
+	rtm := unix.RtMsg{
+		Family:  family,
+		Src_len: uint8(len(srcIP) * 8),
+		Type:    frActToTbl,
+	}
+	if table < 256 {
+		rtm.Table = uint8(table)
+	}
+	err := c.request(unix.RTM_NEWRULE, unix.NLM_F_CREATE|unix.NLM_F_EXCL, rtm,
+		nlAttr{attrType: fraSrc, data: srcIP},
+		nlAttrUint32(fraTable, table))
+	if err == syscall.EEXIST {
+		return nil
+	}
+	return err
+}
+
+// delete the rules of an address family that look up a routing table
+func (c *netlinkConn) delTableRules(family uint8, table uint32) error {
+	rtm := unix.RtMsg{Family: family}
+	if table < 256 {
+		rtm.Table = uint8(table)
+	}
+	for {
+		err := c.request(unix.RTM_DELRULE, 0, rtm, nlAttrUint32(fraTable, table))
+		// EAFNOSUPPORT when the address family is disabled in the netns
+		if err == syscall.ENOENT || err == syscall.EAFNOSUPPORT {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,81 @@
+/*
+Copyright (c) 2021 Kaloom Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"runtime"
+
+	"golang.org/x/sys/unix"
+)
+
+// run fn in a network namespace; the thread is switched to the netns, it's
+// done in its own goroutine locked to the thread and if the thread can't
+// be switched back to its netns, it's left locked so that it gets
+// terminated with the goroutine
+func withNetns(netnsPath string, fn func() error) error {
+	ch := make(chan error, 1)
+	go func() {
+		runtime.LockOSThread()
+
+		current, err := os.Open(fmt.Sprintf("/proc/self/task/%d/ns/net", unix.Gettid()))
+		if err != nil {
+			runtime.UnlockOSThread()
+			ch <- fmt.Errorf("failed to open the current netns: %v", err)
+			return
+		}
+		defer current.Close()
+		target, err := os.Open(netnsPath)
+		if err != nil {
+			runtime.UnlockOSThread()
+			ch <- fmt.Errorf("failed to open the netns %s: %v", netnsPath, err)
+			return
+		}
+		defer target.Close()
+
+		if err := unix.Setns(int(target.Fd()), unix.CLONE_NEWNET); err != nil {
+			runtime.UnlockOSThread()
+			ch <- fmt.Errorf("failed to switch to the netns %s: %v", netnsPath, err)
+			return
+		}
+		err = fn()
+		if unix.Setns(int(current.Fd()), unix.CLONE_NEWNET) == nil {
+			runtime.UnlockOSThread()
+		}
+		ch <- err
+	}()
+	return <-ch
+}
+
+// list the names of the network devices in a network namespace
+func getNetnsLinks(netnsPath string) (map[string]bool, error) {
+	var links map[string]bool
+	err := withNetns(netnsPath, func() error {
+		ifaces, err := net.Interfaces()
+		if err != nil {
+			return fmt.Errorf("failed to list the network devices of the netns %s: %v", netnsPath, err)
+		}
+		links = make(map[string]bool, len(ifaces))
+		for _, iface := range ifaces {
+			links[iface.Name] = true
+		}
+		return nil
+	})
+	return links, err
+}
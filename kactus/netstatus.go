@@ -0,0 +1,192 @@
+/*
+Copyright (c) 2021 Kaloom Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	kc "github.com/kaloom/kubernetes-common"
+
+	"golang.org/x/net/context"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	k8stypes "k8s.io/apimachinery/pkg/types"
+
+	"github.com/containernetworking/cni/pkg/types"
+	types100 "github.com/containernetworking/cni/pkg/types/100"
+)
+
+const (
+	networkStatusAnnot = "k8s.v1.cni.cncf.io/network-status"
+
+	// the number of attempts to update the network-status annotation when
+	// the update conflicts with a concurrent update of the Pod
+	networkStatusUpdateAttempts = 5
+)
+
+// networkStatus is the status of a network attachment as published in
+// the Pod's network-status annotation, see the Network Plumbing WG
+// specification
+type networkStatus struct {
+	Name      string     `json:"name"`
+	Interface string     `json:"interface,omitempty"`
+	IPs       []string   `json:"ips,omitempty"`
+	Mac       string     `json:"mac,omitempty"`
+	Default   bool       `json:"default,omitempty"`
+	DNS       *types.DNS `json:"dns,omitempty"`
+}
+
+func isDNSEmpty(dns *types.DNS) bool {
+	return len(dns.Nameservers) == 0 && dns.Domain == "" && len(dns.Search) == 0 && len(dns.Options) == 0
+}
+
+// the name under which a delegate is published in the network-status
+// annotation, <namespace>/<network name> for network attachments and
+// kactus's network name for the master plugin
+func getNetworkStatusName(defaultName string, delegate map[string]interface{}) string {
+	if !isString(delegate["networkName"]) {
+		return defaultName
+	}
+	if isString(delegate["networkNamespace"]) && delegate["networkNamespace"].(string) != "" {
+		return fmt.Sprintf("%s/%s", delegate["networkNamespace"].(string), delegate["networkName"].(string))
+	}
+	return delegate["networkName"].(string)
+}
+
+// build the network status of a delegate off the result it returned
+func getNetworkStatus(name, ifName, ifMAC string, isDefault bool, r types.Result) *networkStatus {
+	ns := &networkStatus{
+		Name:      name,
+		Interface: ifName,
+		Mac:       ifMAC,
+		Default:   isDefault,
+	}
+	if r == nil {
+		return ns
+	}
+
+	res, err := types100.NewResultFromResult(r)
+	if err != nil {
+		kc.LogError("getNetworkStatus: failed to convert the result of network %s: %v\n", name, err)
+		return ns
+	}
+
+	ifIndex := -1
+	for i, intf := range res.Interfaces {
+		if intf.Sandbox != "" && intf.Name == ifName {
+			ifIndex = i
+			if intf.Mac != "" {
+				ns.Mac = intf.Mac
+			}
+			break
+		}
+	}
+	for _, ip := range res.IPs {
+		if ifIndex >= 0 && ip.Interface != nil && *ip.Interface != ifIndex {
+			continue
+		}
+		ns.IPs = append(ns.IPs, ip.Address.IP.String())
+	}
+	if !isDNSEmpty(&res.DNS) {
+		ns.DNS = &res.DNS
+	}
+
+	return ns
+}
+
+// merge the network statuses of the added networks and drop the removed
+// ones from the existing network statuses, an added network replaces an
+// existing one with the same name
+func mergeNetworkStatuses(existing, added []*networkStatus, removed []string) []*networkStatus {
+	drop := make(map[string]bool)
+	for _, name := range removed {
+		drop[name] = true
+	}
+	for _, ns := range added {
+		drop[ns.Name] = true
+	}
+
+	merged := []*networkStatus{}
+	for _, ns := range existing {
+		if !drop[ns.Name] {
+			merged = append(merged, ns)
+		}
+	}
+	return append(merged, added...)
+}
+
+// publish the network statuses in the Pod's network-status annotation;
+// when kactus got invoked by the podagent the statuses are merged with
+// the ones already in the annotation, otherwise they replace them
+func (cc *cniContext) updateNetworkStatus(added []*networkStatus, removed []string) error {
+	podNamespace := string(cc.cniArgs.K8S_POD_NAMESPACE)
+	podName := string(cc.cniArgs.K8S_POD_NAME)
+	if podNamespace == "" || podName == "" || cc.k8sclient == nil {
+		kc.LogDebug("updateNetworkStatus: no Pod to update\n")
+		return nil
+	}
+
+	pods := cc.k8sclient.CoreV1().Pods(podNamespace)
+	update := func() error {
+		pod, err := pods.Get(context.TODO(), podName, metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+
+		statuses := added
+		if cc.auxNetOnly {
+			var existing []*networkStatus
+			if annot := pod.Annotations[networkStatusAnnot]; annot != "" {
+				if err := json.Unmarshal([]byte(annot), &existing); err != nil {
+					kc.LogError("updateNetworkStatus: ignoring the malformed %s annotation of pod %s: %v\n", networkStatusAnnot, podName, err)
+				}
+			}
+			statuses = mergeNetworkStatuses(existing, added, removed)
+		}
+
+		statusBytes, err := json.Marshal(statuses)
+		if err != nil {
+			return fmt.Errorf("failed to serialize the network status: %v", err)
+		}
+		patch := map[string]interface{}{
+			"metadata": map[string]interface{}{
+				"resourceVersion": pod.ResourceVersion,
+				"annotations": map[string]string{
+					networkStatusAnnot: string(statusBytes),
+				},
+			},
+		}
+		patchBytes, err := json.Marshal(patch)
+		if err != nil {
+			return fmt.Errorf("failed to serialize the network status patch: %v", err)
+		}
+		kc.LogDebug("updateNetworkStatus: patching pod %s/%s with %s\n", podNamespace, podName, patchBytes)
+		_, err = pods.Patch(context.TODO(), podName, k8stypes.MergePatchType, patchBytes, metav1.PatchOptions{})
+		return err
+	}
+
+	for attempt := 1; ; attempt++ {
+		err := update()
+		if err == nil || !apierrors.IsConflict(err) || attempt == networkStatusUpdateAttempts {
+			return err
+		}
+		kc.LogDebug("updateNetworkStatus: conflict updating pod %s/%s, retrying: %v\n", podNamespace, podName, err)
+		time.Sleep(time.Duration(attempt) * 10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,192 @@
+/*
+Copyright (c) 2021 Kaloom Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	kc "github.com/kaloom/kubernetes-common"
+
+	"github.com/containernetworking/cni/pkg/types"
+)
+
+// the delegates are invoked one after another unless maxParallelDelegates
+// is set in kactus config, in which case the master plugin is invoked on
+// its own (first on ADD, last on DEL) and the delegates of the auxiliary
+// networks are invoked concurrently, at most maxParallelDelegates at a time
+
+func (cc *cniContext) isParallel() bool {
+	return cc.netconf.MaxParallelDelegates > 1
+}
+
+// run fn for the given delegates indexes, at most maxParallelDelegates at
+// a time; once fn fails for a delegate the delegates that didn't start
+// yet are skipped when stopOnError is set. Returns the errors indexed as
+// the delegates
+func (cc *cniContext) runParallel(indexes []int, count int, stopOnError bool, fn func(i int) error) []error {
+	errs := make([]error, count)
+
+	var mu sync.Mutex
+	var failed bool
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, cc.netconf.MaxParallelDelegates)
+	for _, i := range indexes {
+		sem <- struct{}{}
+		mu.Lock()
+		skip := stopOnError && failed
+		mu.Unlock()
+		if skip {
+			<-sem
+			break
+		}
+
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			err := fn(i)
+			mu.Lock()
+			errs[i] = err
+			if err != nil {
+				failed = true
+			}
+			mu.Unlock()
+		}(i)
+	}
+	wg.Wait()
+	return errs
+}
+
+// returns the indexes, among the given ones, of the master plugin and
+// auxiliary delegates
+func splitDelegates(delegates []map[string]interface{}, indexes []int) ([]int, []int) {
+	var masters, aux []int
+	for _, i := range indexes {
+		if isMasterplugin(delegates[i]) {
+			masters = append(masters, i)
+		} else {
+			aux = append(aux, i)
+		}
+	}
+	return masters, aux
+}
+
+// invoke the ADD of the delegates layer by layer (see getDelegateLayers),
+// the results are returned in the order of the delegates; on error what
+// got set up is in the transaction so that it can be rolled back
+func (cc *cniContext) addDelegates(networks []networkConfig, argIfName string, delegates []map[string]interface{}) ([]types.Result, error) {
+	layers, err := getDelegateLayers(delegates)
+	if err != nil {
+		return nil, fmt.Errorf("Kactus: %v", err)
+	}
+
+	results := make([]types.Result, len(delegates))
+	if !cc.isParallel() {
+		for _, layer := range layers {
+			for _, i := range layer {
+				err, r := cc.delegateAdd(networks[i], argIfName, delegates[i])
+				if err != nil {
+					return nil, err
+				}
+				results[i] = r
+			}
+		}
+		return results, nil
+	}
+
+	for _, layer := range layers {
+		masters, aux := splitDelegates(delegates, layer)
+		for _, i := range masters {
+			err, r := cc.delegateAdd(networks[i], argIfName, delegates[i])
+			if err != nil {
+				return nil, err
+			}
+			results[i] = r
+		}
+
+		kc.LogDebug("addDelegates: invoking %d delegates, %d at a time\n", len(aux), cc.netconf.MaxParallelDelegates)
+		errs := cc.runParallel(aux, len(delegates), true, func(i int) error {
+			err, r := cc.delegateAdd(networks[i], argIfName, delegates[i])
+			results[i] = r
+			return err
+		})
+		for _, i := range aux {
+			if errs[i] != nil {
+				return nil, errs[i]
+			}
+		}
+	}
+	return results, nil
+}
+
+// invoke the DEL of every delegate even when some of them fail, so that
+// the failed ones are the only ones left for a later DEL to retry; returns
+// the delegates that got torn down along with an error listing each of the
+// networks whose DEL failed. The layers are deleted in reverse order (see
+// getDelegateLayers) and the master plugin is deleted last
+func (cc *cniContext) delDelegates(argIfName string, delegates []map[string]interface{}) ([]map[string]interface{}, error) {
+	layers, err := getDelegateLayers(delegates)
+	if err != nil {
+		kc.LogError("delDelegates: %v, deleting the delegates in their recorded order\n", err)
+		all := make([]int, len(delegates))
+		for i := range all {
+			all[i] = i
+		}
+		layers = [][]int{all}
+	}
+
+	errs := make([]error, len(delegates))
+	var masters []int
+	for l := len(layers) - 1; l >= 0; l-- {
+		if !cc.isParallel() {
+			for _, i := range layers[l] {
+				errs[i] = cc.delegateDel(argIfName, delegates[i])
+			}
+			continue
+		}
+
+		layerMasters, aux := splitDelegates(delegates, layers[l])
+		masters = append(masters, layerMasters...)
+		kc.LogDebug("delDelegates: deleting %d delegates, %d at a time\n", len(aux), cc.netconf.MaxParallelDelegates)
+		layerErrs := cc.runParallel(aux, len(delegates), false, func(i int) error {
+			return cc.delegateDel(argIfName, delegates[i])
+		})
+		for _, i := range aux {
+			errs[i] = layerErrs[i]
+		}
+	}
+	for _, i := range masters {
+		errs[i] = cc.delegateDel(argIfName, delegates[i])
+	}
+
+	var tornDown []map[string]interface{}
+	var failures []string
+	for i, delegate := range delegates {
+		if errs[i] != nil {
+			kc.LogError("delDelegates: network %s: %v\n", getDelegateName(delegate), errs[i])
+			failures = append(failures, fmt.Sprintf("network %s: %v", getDelegateName(delegate), errs[i]))
+			continue
+		}
+		tornDown = append(tornDown, delegate)
+	}
+	if len(failures) > 0 {
+		return tornDown, fmt.Errorf("Kactus: DEL failed for %d network attachment(s): %s", len(failures), strings.Join(failures, "; "))
+	}
+	return tornDown, nil
+}
@@ -0,0 +1,53 @@
+/*
+Copyright (c) 2021 Kaloom Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"testing"
+
+	"github.com/containernetworking/cni/pkg/skel"
+)
+
+func TestAddDelegatesOfKactusConfig(t *testing.T) {
+	for _, maxParallel := range []int{0, 2} {
+		cniPath := t.TempDir()
+		writeFakePlugin(t, cniPath, "fake")
+
+		cc := cniContext{
+			args:    &skel.CmdArgs{ContainerID: "container", IfName: "eth0"},
+			cniPath: cniPath,
+			netconf: &netConf{MaxParallelDelegates: maxParallel},
+		}
+		delegates := []map[string]interface{}{
+			{"cniVersion": "0.4.0", "name": "master", "type": "fake", "masterPlugin": true},
+			{"cniVersion": "0.4.0", "name": "tuning", "type": "fake"},
+			{"cniVersion": "0.4.0", "name": "aux", "type": "fake", "networkName": "aux"},
+		}
+		networks := append(getConfigNetworks(delegates[:2]), networkConfig{Interface: "net1"})
+		if len(networks) != len(delegates) {
+			t.Fatalf("expected %d networks, got %d", len(delegates), len(networks))
+		}
+
+		results, err := cc.addDelegates(networks, "eth0", delegates)
+		if err != nil {
+			t.Fatalf("maxParallelDelegates %d: unexpected error: %v", maxParallel, err)
+		}
+		if len(results) != len(delegates) {
+			t.Errorf("maxParallelDelegates %d: expected %d results, got %d", maxParallel, len(delegates), len(results))
+		}
+	}
+}
@@ -0,0 +1,146 @@
+/*
+Copyright (c) 2021 Kaloom Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+
+	kc "github.com/kaloom/kubernetes-common"
+)
+
+// strip the // and /* */ comments off a JSON document, comments found
+// within JSON strings are left as is
+func stripJSONComments(config string) string {
+	var out strings.Builder
+	inString, escaped := false, false
+	for i := 0; i < len(config); i++ {
+		c := config[i]
+		if inString {
+			out.WriteByte(c)
+			switch {
+			case escaped:
+				escaped = false
+			case c == '\\':
+				escaped = true
+			case c == '"':
+				inString = false
+			}
+			continue
+		}
+
+		switch {
+		case c == '"':
+			inString = true
+			out.WriteByte(c)
+		case c == '/' && i+1 < len(config) && config[i+1] == '/':
+			for i < len(config) && config[i] != '\n' {
+				i++
+			}
+			if i < len(config) {
+				out.WriteByte('\n')
+			}
+		case c == '/' && i+1 < len(config) && config[i+1] == '*':
+			end := strings.Index(config[i+2:], "*/")
+			if end < 0 {
+				i = len(config)
+			} else {
+				i += end + 3
+			}
+			out.WriteByte(' ')
+		default:
+			out.WriteByte(c)
+		}
+	}
+	return out.String()
+}
+
+// parse the JSON-formatted CNI configuration of a network attachment
+// resource, numbers are kept as json.Number so that they are passed as is
+// to the delegate
+func parsePluginConfig(config string) (map[string]interface{}, error) {
+	stripped := strings.TrimSpace(stripJSONComments(config))
+	if stripped == "" {
+		return nil, fmt.Errorf("config can't be empty")
+	}
+
+	conf := map[string]interface{}{}
+	dec := json.NewDecoder(strings.NewReader(stripped))
+	dec.UseNumber()
+	if err := dec.Decode(&conf); err != nil {
+		return nil, fmt.Errorf("config is not a valid JSON object: %v", err)
+	}
+	if _, err := dec.Token(); err != io.EOF {
+		return nil, fmt.Errorf("config has trailing data after its JSON object")
+	}
+	if conf == nil {
+		return nil, fmt.Errorf("config is not a valid JSON object")
+	}
+	return conf, nil
+}
+
+// from the CRD networks's config, create a netconf for the delegate
+// cni-plugin; the config is parsed as JSON and the fields kactus injects
+// are merged in as follows:
+//   - "type" is set to the CR plugin, a config "type" that doesn't match the
+//     CR plugin is rejected
+//   - "networkName" and "networkNamespace" are always set by kactus
+//   - "deviceID" and "resourceName" are set by kactus when it allocated a
+//     device to the network attachment, otherwise the config's are kept
+//   - "masterPlugin" is set by kactus on the primary network attachment
+//     only, a config can't make itself the master plugin
+func getPluginNetConf(no *netObject, deviceID, resourceName string, primary bool) (map[string]interface{}, error) {
+	crName := fmt.Sprintf("%s/%s", no.Namespace, no.Name)
+	if no.Spec.Plugin == "" {
+		return nil, fmt.Errorf("Kactus: network %s: plugin name can't be empty", crName)
+	}
+
+	netconf, err := parsePluginConfig(no.Spec.Config)
+	if err != nil {
+		return nil, fmt.Errorf("Kactus: network %s: invalid spec.config: %v", crName, err)
+	}
+
+	if t, ok := netconf["type"]; ok {
+		if !isString(t) {
+			return nil, fmt.Errorf("Kactus: network %s: spec.config field 'type' must be a string", crName)
+		}
+		if t.(string) != no.Spec.Plugin {
+			return nil, fmt.Errorf("Kactus: network %s: spec.plugin %q doesn't match the spec.config type %q", crName, no.Spec.Plugin, t)
+		}
+	}
+	netconf["type"] = no.Spec.Plugin
+
+	for _, field := range []string{"networkName", "networkNamespace", "masterPlugin", "masterplugin", lowerLayersField, podRoutingField} {
+		if _, ok := netconf[field]; ok {
+			kc.LogDebug("getPluginNetConf: network %s: overriding the spec.config field '%s'\n", crName, field)
+			delete(netconf, field)
+		}
+	}
+	netconf["networkName"] = no.Name
+	netconf["networkNamespace"] = no.Namespace
+	if deviceID != "" {
+		netconf["deviceID"] = deviceID
+		netconf["resourceName"] = resourceName
+	}
+	if primary {
+		netconf["masterPlugin"] = true
+	}
+
+	return netconf, nil
+}
@@ -0,0 +1,242 @@
+/*
+Copyright (c) 2021 Kaloom Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+
+	kaloomv1 "github.com/kaloom/kubernetes-kactus-cni-plugin/pkg/apis/kaloom/v1"
+)
+
+func TestStripJSONComments(t *testing.T) {
+	tests := []struct {
+		name     string
+		config   string
+		expected string
+	}{
+		{
+			name:     "no comments",
+			config:   `{"type": "bridge"}`,
+			expected: `{"type": "bridge"}`,
+		},
+		{
+			name:     "line comment",
+			config:   "{\"type\": \"bridge\" // the plugin\n}",
+			expected: "{\"type\": \"bridge\" \n}",
+		},
+		{
+			name:     "line comment at the end",
+			config:   `{"type": "bridge"} // the plugin`,
+			expected: `{"type": "bridge"} `,
+		},
+		{
+			name:     "block comment",
+			config:   `{/* the plugin */"type": "bridge"}`,
+			expected: `{ "type": "bridge"}`,
+		},
+		{
+			name:     "unterminated block comment",
+			config:   `{"type": "bridge"} /* the plugin`,
+			expected: `{"type": "bridge"}  `,
+		},
+		{
+			name:     "comments within strings",
+			config:   `{"url": "http://host/*path*/", "note": "a // b"}`,
+			expected: `{"url": "http://host/*path*/", "note": "a // b"}`,
+		},
+		{
+			name:     "escaped quotes within strings",
+			config:   `{"note": "a \"//\" b\\"} // comment`,
+			expected: `{"note": "a \"//\" b\\"} `,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := stripJSONComments(tt.config); got != tt.expected {
+				t.Errorf("expected %q, got %q", tt.expected, got)
+			}
+		})
+	}
+}
+
+func TestParsePluginConfig(t *testing.T) {
+	tests := []struct {
+		name     string
+		config   string
+		expected map[string]interface{}
+		err      string
+	}{
+		{
+			name:     "numbers are kept as is",
+			config:   `{"type": "bridge", "mtu": 1500, "ratio": 1.50}`,
+			expected: map[string]interface{}{"type": "bridge", "mtu": json.Number("1500"), "ratio": json.Number("1.50")},
+		},
+		{
+			name:     "comments",
+			config:   "{\n  // the plugin\n  \"type\": \"bridge\" /* inline */\n}",
+			expected: map[string]interface{}{"type": "bridge"},
+		},
+		{
+			name:   "empty",
+			config: " // nothing\n",
+			err:    "config can't be empty",
+		},
+		{
+			name:   "not an object",
+			config: `["bridge"]`,
+			err:    "config is not a valid JSON object",
+		},
+		{
+			name:   "null",
+			config: `null`,
+			err:    "config is not a valid JSON object",
+		},
+		{
+			name:   "trailing object",
+			config: `{"type": "a"} {"type": "b"}`,
+			err:    "trailing data",
+		},
+		{
+			name:   "trailing brace",
+			config: `{"type": "a"}}`,
+			err:    "trailing data",
+		},
+		{
+			name:   "trailing bracket",
+			config: `{"type": "a"}]`,
+			err:    "trailing data",
+		},
+		{
+			name:     "trailing comment",
+			config:   `{"type": "a"} // done`,
+			expected: map[string]interface{}{"type": "a"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conf, err := parsePluginConfig(tt.config)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("expected error %q, got %v", tt.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(conf, tt.expected) {
+				t.Errorf("expected %v, got %v", tt.expected, conf)
+			}
+		})
+	}
+}
+
+func TestGetPluginNetConf(t *testing.T) {
+	network := func(plugin, config string) *netObject {
+		return &netObject{
+			ObjectMeta: metav1.ObjectMeta{Namespace: "ns", Name: "net"},
+			Spec:       kaloomv1.NetworkSpec{Plugin: plugin, Config: config},
+		}
+	}
+
+	tests := []struct {
+		name         string
+		no           *netObject
+		deviceID     string
+		resourceName string
+		primary      bool
+		expected     map[string]interface{}
+		err          string
+	}{
+		{
+			name: "type set off the plugin",
+			no:   network("bridge", `{"cniVersion": "0.4.0", "name": "br"}`),
+			expected: map[string]interface{}{
+				"cniVersion": "0.4.0", "name": "br", "type": "bridge",
+				"networkName": "net", "networkNamespace": "ns",
+			},
+		},
+		{
+			name: "kactus fields are overridden",
+			no:   network("bridge", `{"type": "bridge", "networkName": "other", "masterPlugin": true, "lowerLayers": ["x"]}`),
+			expected: map[string]interface{}{
+				"type": "bridge", "networkName": "net", "networkNamespace": "ns",
+			},
+		},
+		{
+			name:         "allocated device",
+			no:           network("sriov", `{"deviceID": "0000:00:00.0"}`),
+			deviceID:     "0000:01:00.1",
+			resourceName: "kaloom.com/vf",
+			primary:      true,
+			expected: map[string]interface{}{
+				"type": "sriov", "networkName": "net", "networkNamespace": "ns",
+				"deviceID": "0000:01:00.1", "resourceName": "kaloom.com/vf", "masterPlugin": true,
+			},
+		},
+		{
+			name:     "config device kept",
+			no:       network("sriov", `{"deviceID": "0000:00:00.0"}`),
+			expected: map[string]interface{}{"type": "sriov", "networkName": "net", "networkNamespace": "ns", "deviceID": "0000:00:00.0"},
+		},
+		{
+			name: "type mismatch",
+			no:   network("bridge", `{"type": "macvlan"}`),
+			err:  `spec.plugin "bridge" doesn't match the spec.config type "macvlan"`,
+		},
+		{
+			name: "type not a string",
+			no:   network("bridge", `{"type": 1}`),
+			err:  "field 'type' must be a string",
+		},
+		{
+			name: "no plugin",
+			no:   network("", `{}`),
+			err:  "plugin name can't be empty",
+		},
+		{
+			name: "invalid config",
+			no:   network("bridge", `{"type": "bridge"`),
+			err:  "invalid spec.config",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			netconf, err := getPluginNetConf(tt.no, tt.deviceID, tt.resourceName, tt.primary)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("expected error %q, got %v", tt.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(netconf, tt.expected) {
+				t.Errorf("expected %v, got %v", tt.expected, netconf)
+			}
+		})
+	}
+}
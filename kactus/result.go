@@ -0,0 +1,85 @@
+/*
+Copyright (c) 2021 Kaloom Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+
+	"github.com/containernetworking/cni/pkg/types"
+	types100 "github.com/containernetworking/cni/pkg/types/100"
+)
+
+// merge the results of the delegates into the result kactus returns, the
+// results are converted to the current result version and merged in
+// order where the master plugin's result comes first so that its ips stay
+// the primary ones; the ips of a result refer to its interfaces by index
+// so they get shifted by the number of interfaces merged before it. The
+// delegates without a result are skipped
+func mergeResults(results []types.Result, masterIdx int) (*types100.Result, error) {
+	order := make([]int, 0, len(results))
+	if masterIdx >= 0 {
+		order = append(order, masterIdx)
+	}
+	for i := range results {
+		if i != masterIdx {
+			order = append(order, i)
+		}
+	}
+
+	merged := &types100.Result{CNIVersion: types100.ImplementedSpecVersion}
+	for _, i := range order {
+		if results[i] == nil {
+			continue
+		}
+		res, err := types100.NewResultFromResult(results[i])
+		if err != nil {
+			return nil, fmt.Errorf("failed to convert the result of delegate %d: %v", i, err)
+		}
+
+		offset := len(merged.Interfaces)
+		for _, intf := range res.Interfaces {
+			merged.Interfaces = append(merged.Interfaces, &types100.Interface{
+				Name:    intf.Name,
+				Mac:     intf.Mac,
+				Sandbox: intf.Sandbox,
+			})
+		}
+		for _, ipc := range res.IPs {
+			ip := &types100.IPConfig{
+				Address: ipc.Address,
+				Gateway: ipc.Gateway,
+			}
+			if ipc.Interface != nil {
+				ip.Interface = types100.Int(*ipc.Interface + offset)
+			}
+			merged.IPs = append(merged.IPs, ip)
+		}
+		merged.Routes = append(merged.Routes, res.Routes...)
+		if isDNSEmpty(&merged.DNS) {
+			merged.DNS = res.DNS
+		}
+	}
+	return merged, nil
+}
+
+// convert the merged result to the cniVersion kactus got invoked with
+func getResultAsVersion(merged *types100.Result, cniVersion string) (types.Result, error) {
+	if cniVersion == "" || cniVersion == merged.CNIVersion {
+		return merged, nil
+	}
+	return merged.GetAsVersion(cniVersion)
+}
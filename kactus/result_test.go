@@ -0,0 +1,124 @@
+/*
+Copyright (c) 2021 Kaloom Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/containernetworking/cni/pkg/types"
+	"github.com/containernetworking/cni/pkg/types/create"
+)
+
+func parseResult(t *testing.T, data string) types.Result {
+	t.Helper()
+	r, err := create.CreateFromBytes([]byte(data))
+	if err != nil {
+		t.Fatalf("failed to parse result %s: %v", data, err)
+	}
+	return r
+}
+
+func TestMergeResults(t *testing.T) {
+	tests := []struct {
+		name      string
+		results   []string
+		masterIdx int
+		expected  string
+	}{
+		{
+			name: "master plugin first",
+			results: []string{
+				`{"cniVersion": "1.0.0", "interfaces": [{"name": "net1"}], "ips": [{"interface": 0, "address": "10.1.0.2/24"}]}`,
+				`{"cniVersion": "1.0.0", "interfaces": [{"name": "cni0"}, {"name": "veth0"}, {"name": "eth0", "sandbox": "/ns"}], "ips": [{"interface": 2, "address": "10.0.0.2/24", "gateway": "10.0.0.1"}], "routes": [{"dst": "0.0.0.0/0"}], "dns": {"nameservers": ["10.0.0.10"]}}`,
+			},
+			masterIdx: 1,
+			expected:  `{"cniVersion":"1.0.0","interfaces":[{"name":"cni0"},{"name":"veth0"},{"name":"eth0","sandbox":"/ns"},{"name":"net1"}],"ips":[{"interface":2,"address":"10.0.0.2/24","gateway":"10.0.0.1"},{"interface":3,"address":"10.1.0.2/24"}],"routes":[{"dst":"0.0.0.0/0"}],"dns":{"nameservers":["10.0.0.10"]}}`,
+		},
+		{
+			name: "offsets across older result versions",
+			results: []string{
+				`{"cniVersion": "0.4.0", "interfaces": [{"name": "eth0"}], "ips": [{"version": "4", "interface": 0, "address": "10.0.0.2/24"}], "dns": {"domain": "first"}}`,
+				`{"cniVersion": "0.3.1", "interfaces": [{"name": "br"}, {"name": "net1"}], "ips": [{"version": "4", "interface": 1, "address": "10.1.0.2/24"}], "dns": {"domain": "second"}}`,
+				`{"cniVersion": "0.4.0", "interfaces": [{"name": "net2"}], "ips": [{"version": "4", "interface": 0, "address": "10.2.0.2/24"}]}`,
+			},
+			masterIdx: 0,
+			expected:  `{"cniVersion":"1.0.0","interfaces":[{"name":"eth0"},{"name":"br"},{"name":"net1"},{"name":"net2"}],"ips":[{"interface":0,"address":"10.0.0.2/24"},{"interface":2,"address":"10.1.0.2/24"},{"interface":3,"address":"10.2.0.2/24"}],"dns":{"domain":"first"}}`,
+		},
+		{
+			name: "ips without an interface and missing results",
+			results: []string{
+				"",
+				`{"cniVersion": "0.2.0", "ip4": {"ip": "10.1.0.2/24"}}`,
+				`{"cniVersion": "1.0.0", "interfaces": [{"name": "net2"}], "ips": [{"interface": 0, "address": "10.2.0.2/24"}]}`,
+			},
+			masterIdx: -1,
+			expected:  `{"cniVersion":"1.0.0","interfaces":[{"name":"net2"}],"ips":[{"address":"10.1.0.2/24"},{"interface":0,"address":"10.2.0.2/24"}],"dns":{}}`,
+		},
+		{
+			name:      "no results",
+			results:   []string{"", ""},
+			masterIdx: 0,
+			expected:  `{"cniVersion":"1.0.0","dns":{}}`,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			results := make([]types.Result, len(tt.results))
+			for i, data := range tt.results {
+				if data != "" {
+					results[i] = parseResult(t, data)
+				}
+			}
+			merged, err := mergeResults(results, tt.masterIdx)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			data, err := json.Marshal(merged)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(data) != tt.expected {
+				t.Errorf("expected\n%s\ngot\n%s", tt.expected, data)
+			}
+		})
+	}
+}
+
+func TestGetResultAsVersion(t *testing.T) {
+	merged, err := mergeResults([]types.Result{
+		parseResult(t, `{"cniVersion": "1.0.0", "interfaces": [{"name": "eth0"}], "ips": [{"interface": 0, "address": "10.0.0.2/24"}]}`),
+	}, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, cniVersion := range []string{"", "1.0.0", "0.4.0", "0.3.1"} {
+		r, err := getResultAsVersion(merged, cniVersion)
+		if err != nil {
+			t.Fatalf("cniVersion %q: unexpected error: %v", cniVersion, err)
+		}
+		expected := cniVersion
+		if expected == "" {
+			expected = merged.CNIVersion
+		}
+		if r.Version() != expected {
+			t.Errorf("expected a %s result, got a %s one", expected, r.Version())
+		}
+	}
+}
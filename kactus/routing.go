@@ -0,0 +1,251 @@
+/*
+Copyright (c) 2021 Kaloom Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+
+	kc "github.com/kaloom/kubernetes-common"
+
+	"github.com/containernetworking/cni/pkg/types"
+	types100 "github.com/containernetworking/cni/pkg/types/100"
+	"golang.org/x/sys/unix"
+
+	kaloomv1 "github.com/kaloom/kubernetes-kactus-cni-plugin/pkg/apis/kaloom/v1"
+)
+
+// the routes and routingTable of a network attachment are declared in its
+// Network CR spec and/or in the networks Pod annotation, kactus programs
+// them in the Pod's netns once the delegate of the network attachment
+// succeeded: the routes go through the network attachment's device and
+// when a routingTable is set, the routes (along with the subnet and default
+// routes of the device's addresses) go in that table and the traffic
+// sourced from the device's addresses looks it up, so that replies leave
+// on the device the traffic came in on
+
+// the field kactus sets in the netconf of a delegate with the routing of
+// its network attachment
+const podRoutingField = "podRouting"
+
+// routeEntry is a route through the device of a network attachment, a
+// route without a gateway is on link
+type routeEntry = kaloomv1.Route
+
+type podRouting struct {
+	Routes       []routeEntry `json:"routes,omitempty"`
+	RoutingTable int          `json:"routingTable,omitempty"`
+}
+
+// merge the routing of a network attachment, the routes of the networks
+// Pod annotation are added to the ones of the Network CR and its
+// routingTable takes precedence; nil is returned if there is no routing
+func mergePodRouting(cr podRouting, podNet networkConfig) *podRouting {
+	routing := &podRouting{
+		Routes:       append(append([]routeEntry{}, cr.Routes...), podNet.Routes...),
+		RoutingTable: cr.RoutingTable,
+	}
+	if podNet.RoutingTable != 0 {
+		routing.RoutingTable = podNet.RoutingTable
+	}
+	if len(routing.Routes) == 0 && routing.RoutingTable == 0 {
+		return nil
+	}
+	return routing
+}
+
+// validate the routing of a network attachment, the routing tables
+// reserved by the kernel can't be dedicated to it
+func (r *podRouting) validate(primary bool) error {
+	for _, route := range r.Routes {
+		_, dst, err := net.ParseCIDR(route.Dst)
+		if err != nil {
+			return fmt.Errorf("invalid route destination %q, it must be a subnet (ex. 10.2.0.0/16)", route.Dst)
+		}
+		if route.GW == "" {
+			continue
+		}
+		gw := net.ParseIP(route.GW)
+		if gw == nil {
+			return fmt.Errorf("invalid gateway %q of route %s", route.GW, route.Dst)
+		}
+		if (gw.To4() == nil) != (dst.IP.To4() == nil) {
+			return fmt.Errorf("gateway %s of route %s is not of the same address family", gw, route.Dst)
+		}
+	}
+	switch {
+	case r.RoutingTable == 0:
+	case primary:
+		return fmt.Errorf("the primary network uses the main routing table, it can't have a routingTable")
+	case r.RoutingTable < 0:
+		return fmt.Errorf("invalid routingTable %d", r.RoutingTable)
+	case r.RoutingTable >= unix.RT_TABLE_COMPAT && r.RoutingTable <= unix.RT_TABLE_LOCAL:
+		return fmt.Errorf("routingTable %d is reserved", r.RoutingTable)
+	}
+	return nil
+}
+
+// returns the routing of a delegate, nil if it has none
+func getPodRouting(delegate map[string]interface{}) (*podRouting, error) {
+	v, ok := delegate[podRoutingField]
+	if !ok || v == nil {
+		return nil, nil
+	}
+	if routing, ok := v.(*podRouting); ok {
+		return routing, nil
+	}
+	bytes, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	routing := &podRouting{}
+	if err := json.Unmarshal(bytes, routing); err != nil {
+		return nil, fmt.Errorf("invalid %s: %v", podRoutingField, err)
+	}
+	return routing, nil
+}
+
+// make sure that the routing tables of the network attachments are
+// dedicated to them
+func validateRoutingTables(delegates []map[string]interface{}) error {
+	owners := make(map[int]string)
+	for _, delegate := range delegates {
+		routing, err := getPodRouting(delegate)
+		if err != nil || routing == nil || routing.RoutingTable == 0 {
+			continue
+		}
+		name := getDelegateName(delegate)
+		if owner, ok := owners[routing.RoutingTable]; ok {
+			return fmt.Errorf("Kactus: networks %s and %s have the same routingTable %d", owner, name, routing.RoutingTable)
+		}
+		owners[routing.RoutingTable] = name
+	}
+	return nil
+}
+
+// program the routing of a network attachment in the Pod's netns, after
+// its delegate succeeded with the given result
+func (cc *cniContext) setPodRouting(ifName string, delegate map[string]interface{}, result types.Result) error {
+	routing, err := getPodRouting(delegate)
+	if err != nil || routing == nil {
+		return err
+	}
+	if cc.args.Netns == "" {
+		return fmt.Errorf("the Pod has no netns to program the routing of network %s in", getDelegateName(delegate))
+	}
+
+	var ipcs []*types100.IPConfig
+	if result != nil {
+		res, err := types100.NewResultFromResult(result)
+		if err != nil {
+			return fmt.Errorf("failed to convert the result of network %s: %v", getDelegateName(delegate), err)
+		}
+		for _, ipc := range res.IPs {
+			if ipc.Interface == nil || (*ipc.Interface < len(res.Interfaces) && res.Interfaces[*ipc.Interface].Name == ifName) {
+				ipcs = append(ipcs, ipc)
+			}
+		}
+	}
+
+	table := uint32(unix.RT_TABLE_MAIN)
+	if routing.RoutingTable != 0 {
+		table = uint32(routing.RoutingTable)
+	}
+	kc.LogDebug("setPodRouting: network %s, device %s, table %d, routes %+v, ips %d\n", getDelegateName(delegate), ifName, table, routing.Routes, len(ipcs))
+	return withNetns(cc.args.Netns, func() error {
+		link, err := net.InterfaceByName(ifName)
+		if err != nil {
+			return fmt.Errorf("failed to find the device %s: %v", ifName, err)
+		}
+		nl, err := openNetlink()
+		if err != nil {
+			return err
+		}
+		defer nl.Close()
+
+		if routing.RoutingTable != 0 {
+			for _, ipc := range ipcs {
+				subnet := &net.IPNet{IP: ipc.Address.IP.Mask(ipc.Address.Mask), Mask: ipc.Address.Mask}
+				if err := nl.replaceRoute(subnet, nil, ipc.Address.IP, link.Index, table); err != nil {
+					return fmt.Errorf("failed to add route %s dev %s table %d: %v", subnet, ifName, table, err)
+				}
+				if ipc.Gateway != nil {
+					bits := len(ipc.Address.Mask) * 8
+					def := &net.IPNet{IP: make(net.IP, bits/8), Mask: net.CIDRMask(0, bits)}
+					if err := nl.replaceRoute(def, ipc.Gateway, nil, link.Index, table); err != nil {
+						return fmt.Errorf("failed to add route %s via %s dev %s table %d: %v", def, ipc.Gateway, ifName, table, err)
+					}
+				}
+			}
+		}
+		for _, route := range routing.Routes {
+			_, dst, _ := net.ParseCIDR(route.Dst)
+			gw := net.ParseIP(route.GW)
+			if err := nl.replaceRoute(dst, gw, nil, link.Index, table); err != nil {
+				return fmt.Errorf("failed to add route %s via %q dev %s table %d: %v", dst, route.GW, ifName, table, err)
+			}
+		}
+		if routing.RoutingTable != 0 {
+			// the rules of a retried ADD are replaced, the kernel
+			// doesn't see a rule with another priority as a duplicate
+			for _, family := range []uint8{unix.AF_INET, unix.AF_INET6} {
+				if err := nl.delTableRules(family, table); err != nil {
+					return fmt.Errorf("failed to delete the rules of table %d: %v", table, err)
+				}
+			}
+			for _, ipc := range ipcs {
+				if err := nl.addSourceRule(ipc.Address.IP, table); err != nil {
+					return fmt.Errorf("failed to add rule from %s lookup %d: %v", ipc.Address.IP, table, err)
+				}
+			}
+		}
+		return nil
+	})
+}
+
+// remove the rules that look up the routing table of a network attachment
+// from the Pod's netns; its routes go away with its device
+func (cc *cniContext) clearPodRouting(delegate map[string]interface{}) error {
+	routing, err := getPodRouting(delegate)
+	if err != nil || routing == nil || routing.RoutingTable == 0 {
+		return err
+	}
+	if cc.args.Netns == "" {
+		return nil
+	}
+	if _, err := os.Stat(cc.args.Netns); os.IsNotExist(err) {
+		return nil
+	}
+
+	kc.LogDebug("clearPodRouting: network %s, table %d\n", getDelegateName(delegate), routing.RoutingTable)
+	return withNetns(cc.args.Netns, func() error {
+		nl, err := openNetlink()
+		if err != nil {
+			return err
+		}
+		defer nl.Close()
+
+		for _, family := range []uint8{unix.AF_INET, unix.AF_INET6} {
+			if err := nl.delTableRules(family, uint32(routing.RoutingTable)); err != nil {
+				return fmt.Errorf("failed to delete the rules of table %d: %v", routing.RoutingTable, err)
+			}
+		}
+		return nil
+	})
+}
@@ -0,0 +1,107 @@
+/*
+Copyright (c) 2021 Kaloom Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+)
+
+// the runtimeConfig kactus gets from the container runtime is forwarded to
+// the master plugin, the delegates of the network attachments get the
+// runtimeConfig built off the attributes of their network attachment in
+// the networks Pod annotation; either way a delegate only gets the entries
+// of the capabilities it declares
+
+// bandwidthEntry is the bandwidth runtimeConfig capability, rates are in
+// bits per second and bursts in bits
+type bandwidthEntry struct {
+	IngressRate  uint64 `json:"ingressRate,omitempty"`
+	IngressBurst uint64 `json:"ingressBurst,omitempty"`
+	EgressRate   uint64 `json:"egressRate,omitempty"`
+	EgressBurst  uint64 `json:"egressBurst,omitempty"`
+}
+
+// a rate goes along with its burst, like the bandwidth plugin expects
+func (bw *bandwidthEntry) validate() error {
+	if (bw.IngressRate == 0) != (bw.IngressBurst == 0) {
+		return fmt.Errorf("ingressRate and ingressBurst must be set together")
+	}
+	if (bw.EgressRate == 0) != (bw.EgressBurst == 0) {
+		return fmt.Errorf("egressRate and egressBurst must be set together")
+	}
+	return nil
+}
+
+// build the runtimeConfig of a delegate, the master plugin gets the one
+// of the container runtime and the attributes of a network attachment
+// take precedence over it
+func (cc *cniContext) getDelegateRuntimeConfig(masterPlugin bool, network networkConfig) map[string]interface{} {
+	runtimeConfig := make(map[string]interface{})
+	if masterPlugin {
+		for capability, value := range cc.netconf.RuntimeConfig {
+			runtimeConfig[capability] = value
+		}
+	}
+	if network.IfMAC != "" {
+		runtimeConfig["mac"] = network.IfMAC
+	}
+	if len(network.IPs) > 0 {
+		runtimeConfig["ips"] = network.IPs
+	}
+	if network.Bandwidth != nil {
+		runtimeConfig["bandwidth"] = network.Bandwidth
+	}
+	return runtimeConfig
+}
+
+// the runtimeConfig entries a plugin gets are the ones of the capabilities
+// it declares in its netconf, like libcni does; nil is returned if the
+// plugin doesn't declare any of them
+func getPluginRuntimeConfig(plugin, runtimeConfig map[string]interface{}) map[string]interface{} {
+	capabilities, _ := plugin["capabilities"].(map[string]interface{})
+	var rc map[string]interface{}
+	for capability, value := range runtimeConfig {
+		if enabled, _ := capabilities[capability].(bool); !enabled {
+			continue
+		}
+		if rc == nil {
+			rc = make(map[string]interface{})
+		}
+		rc[capability] = value
+	}
+	return rc
+}
+
+// returns a copy of a delegate netconf with its runtimeConfig set, the
+// runtimeConfig of a plugin chain is kept as is on the chain and gets
+// filtered for each of its plugins
+func withRuntimeConfig(netconf, runtimeConfig map[string]interface{}) map[string]interface{} {
+	rc := runtimeConfig
+	if !isPluginChain(netconf) {
+		rc = getPluginRuntimeConfig(netconf, runtimeConfig)
+	}
+	if len(rc) == 0 {
+		return netconf
+	}
+
+	conf := make(map[string]interface{}, len(netconf)+1)
+	for k, v := range netconf {
+		conf[k] = v
+	}
+	conf["runtimeConfig"] = rc
+	return conf
+}
@@ -0,0 +1,407 @@
+/*
+Copyright (c) 2021 Kaloom Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+
+	kc "github.com/kaloom/kubernetes-common"
+
+	"github.com/containernetworking/cni/pkg/types"
+	"github.com/containernetworking/cni/pkg/types/create"
+)
+
+const (
+	// version of the on-disk schema of the delegates store, version 0 is
+	// the legacy format where the file holds a bare array of delegates
+	delegateStoreVersion = 1
+
+	lockFileSuffix    = ".lock"
+	tmpFileSuffix     = ".tmp"
+	corruptFileSuffix = ".corrupt"
+
+	configDelegateKeyPrefix = "#"
+)
+
+// sandboxInfo identifies the Pod sandbox a delegates store belongs to,
+// it's used to garbage collect the stores of sandboxes that are gone
+type sandboxInfo struct {
+	PodNamespace string `json:"podNamespace,omitempty"`
+	PodName      string `json:"podName,omitempty"`
+	PodUID       string `json:"podUID,omitempty"`
+	NetNS        string `json:"netns,omitempty"`
+	IfName       string `json:"ifName,omitempty"`
+}
+
+// on-disk format of the delegates store of a container, the device names
+// of the auxiliary network attachments and the ADD results of the
+// delegates are keyed by getDelegateKey
+type delegateStoreData struct {
+	Version   int                        `json:"version"`
+	Sandbox   sandboxInfo                `json:"sandbox"`
+	Delegates []map[string]interface{}   `json:"delegates"`
+	IfNames   map[string]string          `json:"ifNames,omitempty"`
+	Results   map[string]json.RawMessage `json:"results,omitempty"`
+}
+
+// delegateStore is the record, under the kactus data directory, of the
+// delegates kactus invoked for a container; the podagent and the kubelet
+// may invoke kactus for the same container concurrently so the store is
+// guarded by a per-container flock and it's updated by writing a
+// temporary file that gets renamed over the store, a reader would either
+// see the previous or the new content of the store
+type delegateStore struct {
+	dataDir     string
+	containerID string
+	lockFile    *os.File
+	sandbox     sandboxInfo
+	ifNames     map[string]string
+	results     map[string]json.RawMessage
+	delegates   []map[string]interface{}
+}
+
+func (s *delegateStore) path() string {
+	return filepath.Join(s.dataDir, s.containerID)
+}
+
+// lock the delegates store of a container, the lock is held until Unlock
+// is called
+func lockDelegateStore(dataDir, containerID string) (*delegateStore, error) {
+	if containerID == "" || strings.ContainsRune(containerID, os.PathSeparator) {
+		return nil, fmt.Errorf("invalid container id %q", containerID)
+	}
+	if err := os.MkdirAll(dataDir, 0700); err != nil {
+		return nil, fmt.Errorf("failed to create the kactus data directory(%q): %v", dataDir, err)
+	}
+
+	s := &delegateStore{
+		dataDir:     dataDir,
+		containerID: containerID,
+	}
+	lockPath := s.path() + lockFileSuffix
+	for {
+		f, err := os.OpenFile(lockPath, os.O_RDWR|os.O_CREATE, 0600)
+		if err != nil {
+			return nil, fmt.Errorf("failed to open the lock file(%q): %v", lockPath, err)
+		}
+		if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX); err != nil {
+			f.Close()
+			return nil, fmt.Errorf("failed to lock the lock file(%q): %v", lockPath, err)
+		}
+
+		// the lock file gets removed along with an emptied store, make
+		// sure the one we locked is still the one in the data directory
+		var locked, current syscall.Stat_t
+		if syscall.Fstat(int(f.Fd()), &locked) == nil && syscall.Stat(lockPath, &current) == nil &&
+			locked.Dev == current.Dev && locked.Ino == current.Ino {
+			s.lockFile = f
+			break
+		}
+		f.Close()
+	}
+
+	s.recover()
+	return s, nil
+}
+
+// Unlock releases the lock of the delegates store
+func (s *delegateStore) Unlock() {
+	if s.lockFile == nil {
+		return
+	}
+	syscall.Flock(int(s.lockFile.Fd()), syscall.LOCK_UN)
+	s.lockFile.Close()
+	s.lockFile = nil
+}
+
+// cleanup the leftovers of a kactus invocation that didn't complete
+// updating the store, i.e. a temporary file that didn't get renamed
+func (s *delegateStore) recover() {
+	tmpPath := s.path() + tmpFileSuffix
+	if _, err := os.Stat(tmpPath); err == nil {
+		kc.LogInfo("delegateStore: removing the leftover temporary file %s\n", tmpPath)
+		os.Remove(tmpPath)
+	}
+}
+
+// load the delegates recorded in the store, an empty list is returned
+// if nothing got recorded yet for the container; a store that can't be
+// parsed is moved aside so that it doesn't block future invocations
+func (s *delegateStore) load() ([]map[string]interface{}, error) {
+	path := s.path()
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to read container data in the path(%q): %v", path, err)
+	}
+
+	sd, err := parseDelegateStore(data)
+	if err != nil {
+		corruptPath := path + corruptFileSuffix
+		kc.LogError("delegateStore: failed to parse %s, moving it to %s: %v\n", path, corruptPath, err)
+		if err := os.Rename(path, corruptPath); err != nil {
+			return nil, fmt.Errorf("failed to move the corrupted container data in the path(%q): %v", path, err)
+		}
+		return nil, nil
+	}
+	s.sandbox = sd.Sandbox
+	s.ifNames = sd.IfNames
+	s.results = sd.Results
+	s.delegates = sd.Delegates
+	return sd.Delegates, nil
+}
+
+func parseDelegateStore(data []byte) (*delegateStoreData, error) {
+	if trimmed := strings.TrimSpace(string(data)); strings.HasPrefix(trimmed, "[") {
+		// legacy format
+		var delegates []map[string]interface{}
+		if err := json.Unmarshal(data, &delegates); err != nil {
+			return nil, err
+		}
+		return &delegateStoreData{Delegates: delegates}, nil
+	}
+
+	sd := &delegateStoreData{}
+	if err := json.Unmarshal(data, sd); err != nil {
+		return nil, err
+	}
+	if sd.Version > delegateStoreVersion {
+		return nil, fmt.Errorf("unsupported store version %d", sd.Version)
+	}
+	return sd, nil
+}
+
+// update the sandbox the store belongs to, only the known fields are
+// updated since kactus invoked by the podagent doesn't know the Pod UID
+func (s *delegateStore) setSandbox(sandbox sandboxInfo) {
+	if sandbox.PodNamespace != "" {
+		s.sandbox.PodNamespace = sandbox.PodNamespace
+	}
+	if sandbox.PodName != "" {
+		s.sandbox.PodName = sandbox.PodName
+	}
+	if sandbox.PodUID != "" {
+		s.sandbox.PodUID = sandbox.PodUID
+	}
+	if sandbox.NetNS != "" {
+		s.sandbox.NetNS = sandbox.NetNS
+	}
+	if sandbox.IfName != "" && s.sandbox.IfName == "" {
+		s.sandbox.IfName = sandbox.IfName
+	}
+}
+
+// update the device names of the auxiliary network attachments, only the
+// ones of the saved delegates are kept in the store
+func (s *delegateStore) setIfNames(ifNames map[string]string) {
+	s.ifNames = ifNames
+}
+
+// the ADD result of a delegate recorded in the store, nil if there is none
+func (s *delegateStore) getResult(delegate map[string]interface{}) types.Result {
+	raw, ok := s.results[getDelegateKey(delegate)]
+	if !ok {
+		return nil
+	}
+	r, err := create.CreateFromBytes(raw)
+	if err != nil {
+		kc.LogError("delegateStore: ignoring the unparsable result of network %s: %v\n", getDelegateName(delegate), err)
+		return nil
+	}
+	return r
+}
+
+// record the ADD result of a delegate, a nil result forgets it
+func (s *delegateStore) setResult(delegate map[string]interface{}, r types.Result) error {
+	key := getDelegateKey(delegate)
+	if r == nil {
+		delete(s.results, key)
+		return nil
+	}
+	raw, err := json.Marshal(r)
+	if err != nil {
+		return fmt.Errorf("error serializing the result of network %s: %v", getDelegateName(delegate), err)
+	}
+	if s.results == nil {
+		s.results = make(map[string]json.RawMessage)
+	}
+	s.results[key] = raw
+	return nil
+}
+
+// tells if a delegate got recorded in the store, when it was loaded, with
+// the same netconf
+func (s *delegateStore) isRecorded(delegate map[string]interface{}) bool {
+	key := getDelegateKey(delegate)
+	for _, d := range s.delegates {
+		if getDelegateKey(d) == key {
+			return isSameNetConf(d, delegate)
+		}
+	}
+	return false
+}
+
+// forget the results of the delegates whose netconf changed, they don't
+// describe what the new netconf sets up
+func (s *delegateStore) dropStaleResults(delegates []map[string]interface{}) {
+	for _, delegate := range delegates {
+		if _, ok := s.results[getDelegateKey(delegate)]; ok && !s.isRecorded(delegate) {
+			delete(s.results, getDelegateKey(delegate))
+		}
+	}
+}
+
+// compare two netconfs by their JSON serialization, a netconf loaded off
+// the store has its numbers as float64 while a netconf built off a Network
+// CR has them as json.Number
+func isSameNetConf(a, b map[string]interface{}) bool {
+	aBytes, aErr := json.Marshal(a)
+	bBytes, bErr := json.Marshal(b)
+	return aErr == nil && bErr == nil && bytes.Equal(aBytes, bBytes)
+}
+
+// save the delegates in the store, the store of a container gets removed
+// once it has no delegates
+func (s *delegateStore) save(delegates []map[string]interface{}) error {
+	path := s.path()
+	if len(delegates) == 0 {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("failed to remove container data in the path(%q): %v", path, err)
+		}
+		os.Remove(path + lockFileSuffix)
+		return nil
+	}
+
+	var ifNames map[string]string
+	var results map[string]json.RawMessage
+	for _, d := range delegates {
+		key := getDelegateKey(d)
+		if ifName, ok := s.ifNames[key]; ok && key != "" {
+			if ifNames == nil {
+				ifNames = make(map[string]string)
+			}
+			ifNames[key] = ifName
+		}
+		if r, ok := s.results[key]; ok {
+			if results == nil {
+				results = make(map[string]json.RawMessage)
+			}
+			results[key] = r
+		}
+	}
+
+	data, err := json.Marshal(&delegateStoreData{
+		Version:   delegateStoreVersion,
+		Sandbox:   s.sandbox,
+		Delegates: delegates,
+		IfNames:   ifNames,
+		Results:   results,
+	})
+	if err != nil {
+		return fmt.Errorf("error serializing delegate netconf: %v", err)
+	}
+
+	tmpPath := path + tmpFileSuffix
+	f, err := os.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to create container data in the path(%q): %v", tmpPath, err)
+	}
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("failed to write container data in the path(%q): %v", tmpPath, err)
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("failed to write container data in the path(%q): %v", path, err)
+	}
+
+	// persist the rename
+	if d, err := os.Open(s.dataDir); err == nil {
+		d.Sync()
+		d.Close()
+	}
+	return nil
+}
+
+// the key identifying a delegate in the store: the network attachment
+// name, an empty string for the master plugin or, for the other delegates
+// of kactus config, their netconf name (their type if they have none)
+// prefixed by configDelegateKeyPrefix which can't be in a network name
+func getDelegateKey(delegate map[string]interface{}) string {
+	if isString(delegate["networkName"]) {
+		return delegate["networkName"].(string)
+	}
+	if isMasterplugin(delegate) {
+		return ""
+	}
+	if isString(delegate["name"]) && delegate["name"].(string) != "" {
+		return configDelegateKeyPrefix + delegate["name"].(string)
+	}
+	if isString(delegate["type"]) {
+		return configDelegateKeyPrefix + delegate["type"].(string)
+	}
+	return configDelegateKeyPrefix
+}
+
+// merge delegates in a list of delegates, a delegate replaces the one
+// with the same key in the list
+func mergeDelegates(current, delegates []map[string]interface{}) []map[string]interface{} {
+	keys := make(map[string]bool)
+	for _, d := range delegates {
+		keys[getDelegateKey(d)] = true
+	}
+
+	merged := []map[string]interface{}{}
+	for _, d := range current {
+		if !keys[getDelegateKey(d)] {
+			merged = append(merged, d)
+		}
+	}
+	return append(merged, delegates...)
+}
+
+// remove delegates from a list of delegates
+func removeDelegates(current, delegates []map[string]interface{}) []map[string]interface{} {
+	keys := make(map[string]bool)
+	for _, d := range delegates {
+		keys[getDelegateKey(d)] = true
+	}
+
+	remaining := []map[string]interface{}{}
+	for _, d := range current {
+		if !keys[getDelegateKey(d)] {
+			remaining = append(remaining, d)
+		}
+	}
+	return remaining
+}
@@ -0,0 +1,299 @@
+/*
+Copyright (c) 2021 Kaloom Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	types100 "github.com/containernetworking/cni/pkg/types/100"
+)
+
+func TestGetDelegateKey(t *testing.T) {
+	tests := []struct {
+		name     string
+		delegate map[string]interface{}
+		key      string
+	}{
+		{
+			name:     "network attachment",
+			delegate: map[string]interface{}{"networkName": "net1", "name": "conf", "type": "bridge"},
+			key:      "net1",
+		},
+		{
+			name:     "master plugin",
+			delegate: map[string]interface{}{"masterPlugin": true, "name": "flannel", "type": "flannel"},
+			key:      "",
+		},
+		{
+			name:     "named delegate of kactus config",
+			delegate: map[string]interface{}{"name": "tuning", "type": "tuning"},
+			key:      "#tuning",
+		},
+		{
+			name:     "unnamed delegate of kactus config",
+			delegate: map[string]interface{}{"name": "", "type": "portmap"},
+			key:      "#portmap",
+		},
+		{
+			name:     "delegate without a name nor a type",
+			delegate: map[string]interface{}{},
+			key:      "#",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if key := getDelegateKey(tt.delegate); key != tt.key {
+				t.Errorf("expected key %q, got %q", tt.key, key)
+			}
+		})
+	}
+}
+
+func TestMergeAndRemoveDelegates(t *testing.T) {
+	current := []map[string]interface{}{
+		{"masterPlugin": true, "type": "flannel"},
+		{"networkName": "net1", "type": "bridge"},
+		{"networkName": "net2", "type": "bridge"},
+	}
+	delegates := []map[string]interface{}{
+		{"networkName": "net2", "type": "macvlan"},
+		{"networkName": "net3", "type": "macvlan"},
+	}
+
+	merged := mergeDelegates(current, delegates)
+	expected := []map[string]interface{}{current[0], current[1], delegates[0], delegates[1]}
+	if !reflect.DeepEqual(merged, expected) {
+		t.Errorf("expected merged delegates %v, got %v", expected, merged)
+	}
+
+	remaining := removeDelegates(current, delegates)
+	expected = []map[string]interface{}{current[0], current[1]}
+	if !reflect.DeepEqual(remaining, expected) {
+		t.Errorf("expected remaining delegates %v, got %v", expected, remaining)
+	}
+}
+
+func TestParseDelegateStore(t *testing.T) {
+	tests := []struct {
+		name      string
+		data      string
+		sandbox   sandboxInfo
+		delegates []map[string]interface{}
+		ifNames   map[string]string
+		err       string
+	}{
+		{
+			name:      "legacy format",
+			data:      ` [{"masterPlugin": true, "type": "flannel"}, {"networkName": "net1", "type": "bridge"}]`,
+			delegates: []map[string]interface{}{{"masterPlugin": true, "type": "flannel"}, {"networkName": "net1", "type": "bridge"}},
+		},
+		{
+			name:      "current format",
+			data:      `{"version": 1, "sandbox": {"podNamespace": "ns", "podName": "pod", "netns": "/var/run/netns/x"}, "delegates": [{"networkName": "net1", "type": "bridge"}], "ifNames": {"net1": "net1a"}}`,
+			sandbox:   sandboxInfo{PodNamespace: "ns", PodName: "pod", NetNS: "/var/run/netns/x"},
+			delegates: []map[string]interface{}{{"networkName": "net1", "type": "bridge"}},
+			ifNames:   map[string]string{"net1": "net1a"},
+		},
+		{
+			name: "newer version",
+			data: `{"version": 2, "delegates": []}`,
+			err:  "unsupported store version 2",
+		},
+		{
+			name: "invalid legacy format",
+			data: `[{"type": "bridge"`,
+			err:  "unexpected end of JSON input",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sd, err := parseDelegateStore([]byte(tt.data))
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("expected error %q, got %v", tt.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if sd.Sandbox != tt.sandbox || !reflect.DeepEqual(sd.Delegates, tt.delegates) || !reflect.DeepEqual(sd.IfNames, tt.ifNames) {
+				t.Errorf("unexpected store %+v", sd)
+			}
+		})
+	}
+}
+
+func TestDelegateStoreSaveLoad(t *testing.T) {
+	dataDir := t.TempDir()
+
+	store, err := lockDelegateStore(dataDir, "container")
+	if err != nil {
+		t.Fatal(err)
+	}
+	master := map[string]interface{}{"masterPlugin": true, "type": "flannel"}
+	net1 := map[string]interface{}{"networkName": "net1", "type": "bridge"}
+	net2 := map[string]interface{}{"networkName": "net2", "type": "bridge"}
+	store.setSandbox(sandboxInfo{PodNamespace: "ns", PodName: "pod", NetNS: "/var/run/netns/x", IfName: "eth0"})
+	store.setIfNames(map[string]string{"net1": "net1a", "net2": "net2a"})
+	if err := store.setResult(net1, &types100.Result{CNIVersion: "1.0.0"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.setResult(net2, &types100.Result{CNIVersion: "1.0.0"}); err != nil {
+		t.Fatal(err)
+	}
+	// only the device names and results of the saved delegates are kept
+	if err := store.save([]map[string]interface{}{master, net1}); err != nil {
+		t.Fatal(err)
+	}
+	store.Unlock()
+
+	store, err = lockDelegateStore(dataDir, "container")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Unlock()
+	delegates, err := store.load()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(delegates) != 2 || getDelegateKey(delegates[0]) != "" || getDelegateKey(delegates[1]) != "net1" {
+		t.Errorf("unexpected delegates %v", delegates)
+	}
+	if expected := (sandboxInfo{PodNamespace: "ns", PodName: "pod", NetNS: "/var/run/netns/x", IfName: "eth0"}); store.sandbox != expected {
+		t.Errorf("expected sandbox %+v, got %+v", expected, store.sandbox)
+	}
+	if expected := map[string]string{"net1": "net1a"}; !reflect.DeepEqual(store.ifNames, expected) {
+		t.Errorf("expected device names %v, got %v", expected, store.ifNames)
+	}
+	if store.getResult(net1) == nil || store.getResult(net2) != nil {
+		t.Errorf("expected only the result of net1 to be recorded, got %v", store.results)
+	}
+	if !store.isRecorded(net1) || store.isRecorded(net2) {
+		t.Errorf("expected only net1 to be recorded")
+	}
+	if store.isRecorded(map[string]interface{}{"networkName": "net1", "type": "macvlan"}) {
+		t.Errorf("expected net1 with another netconf not to be recorded")
+	}
+
+	// the podagent doesn't know the Pod UID nor the primary device
+	store.setSandbox(sandboxInfo{PodUID: "uid", IfName: "net1a"})
+	if expected := (sandboxInfo{PodNamespace: "ns", PodName: "pod", PodUID: "uid", NetNS: "/var/run/netns/x", IfName: "eth0"}); store.sandbox != expected {
+		t.Errorf("expected sandbox %+v, got %+v", expected, store.sandbox)
+	}
+
+	// an emptied store is removed along with its lock file
+	if err := store.save(nil); err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range []string{store.path(), store.path() + lockFileSuffix} {
+		if _, err := os.Stat(path); !os.IsNotExist(err) {
+			t.Errorf("expected %s to be removed, got %v", path, err)
+		}
+	}
+}
+
+func TestDelegateStoreRecovery(t *testing.T) {
+	dataDir := t.TempDir()
+	path := filepath.Join(dataDir, "container")
+	if err := ioutil.WriteFile(path, []byte(`{"version": 1, "delegates": [`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path+tmpFileSuffix, []byte(`{}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	store, err := lockDelegateStore(dataDir, "container")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Unlock()
+	if _, err := os.Stat(path + tmpFileSuffix); !os.IsNotExist(err) {
+		t.Errorf("expected the leftover temporary file to be removed, got %v", err)
+	}
+
+	delegates, err := store.load()
+	if err != nil || len(delegates) != 0 {
+		t.Fatalf("expected a corrupted store to load as empty, got %v, %v", delegates, err)
+	}
+	if _, err := os.Stat(path + corruptFileSuffix); err != nil {
+		t.Errorf("expected the corrupted store to be moved aside, got %v", err)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("expected the corrupted store to be removed, got %v", err)
+	}
+}
+
+func TestLockDelegateStore(t *testing.T) {
+	dataDir := t.TempDir()
+	for _, containerID := range []string{"", "a/b"} {
+		if _, err := lockDelegateStore(dataDir, containerID); err == nil {
+			t.Errorf("expected container id %q to be rejected", containerID)
+		}
+	}
+
+	store, err := lockDelegateStore(dataDir, "container")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	locked := make(chan *delegateStore)
+	go func() {
+		s, err := lockDelegateStore(dataDir, "container")
+		if err != nil {
+			t.Error(err)
+		}
+		locked <- s
+	}()
+	select {
+	case <-locked:
+		t.Fatal("expected the store to stay locked")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	// emptying the store removes the lock file the other invocation is
+	// waiting on, it must lock the one that gets recreated
+	if err := store.save(nil); err != nil {
+		t.Fatal(err)
+	}
+	store.Unlock()
+	other := <-locked
+	if other == nil {
+		return
+	}
+	defer other.Unlock()
+
+	var fdStat, pathStat syscall.Stat_t
+	if err := syscall.Fstat(int(other.lockFile.Fd()), &fdStat); err != nil {
+		t.Fatal(err)
+	}
+	if err := syscall.Stat(other.path()+lockFileSuffix, &pathStat); err != nil {
+		t.Fatalf("expected the lock file to be recreated: %v", err)
+	}
+	if fdStat.Ino != pathStat.Ino {
+		t.Errorf("expected the recreated lock file to be locked")
+	}
+}
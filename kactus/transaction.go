@@ -0,0 +1,173 @@
+/*
+Copyright (c) 2021 Kaloom Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+
+	kc "github.com/kaloom/kubernetes-common"
+
+	"github.com/containernetworking/cni/pkg/invoke"
+	"github.com/containernetworking/cni/pkg/types"
+)
+
+// an ADD is a transaction made of the steps that succeeded, i.e. each
+// plugin whose ADD succeeded; when the ADD fails only these steps are
+// undone, in reverse order, with the netconf and args each one used. The
+// network attachments that were found already attached are recorded as
+// well but, as they weren't set up by this ADD, they aren't undone, and
+// so are the ones this ADD deleted to redo them
+
+type addStep struct {
+	// the key of the delegate the step belongs to
+	key  string
+	name string
+	// nil for a step that isn't undone
+	undo func() error
+	// the step deleted a network attachment of a previous ADD
+	deleted bool
+}
+
+type addTransaction struct {
+	mu    sync.Mutex
+	steps []addStep
+}
+
+func (tx *addTransaction) record(step addStep) {
+	if tx == nil {
+		return
+	}
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+	tx.steps = append(tx.steps, step)
+}
+
+// record the ADD of a plugin, it's undone with a DEL using the same netconf
+// and args where the prevResult is the result of the plugin
+func (tx *addTransaction) recordPluginAdd(delegate map[string]interface{}, pluginType string, netconfBytes []byte, args *invoke.Args, result types.Result) {
+	delArgs := *args
+	delArgs.Command = "DEL"
+	tx.record(addStep{
+		key:  getDelegateKey(delegate),
+		name: fmt.Sprintf("network %s plugin %q", getDelegateName(delegate), pluginType),
+		undo: func() error {
+			var conf map[string]interface{}
+			if err := json.Unmarshal(netconfBytes, &conf); err != nil {
+				return fmt.Errorf("failed to parse the netconf used on ADD: %v", err)
+			}
+			delete(conf, "prevResult")
+			if err := setPrevResult(conf, result); err != nil {
+				return err
+			}
+			confBytes, err := json.Marshal(conf)
+			if err != nil {
+				return fmt.Errorf("failed to serialize the netconf: %v", err)
+			}
+			_, err = execPlugin(pluginType, "DEL", confBytes, &delArgs)
+			return err
+		},
+	})
+}
+
+// record a network attachment that was already attached to the sandbox
+// by a previous ADD, it's left in place on a rollback
+func (tx *addTransaction) recordAttached(delegate map[string]interface{}) {
+	tx.record(addStep{
+		key:  getDelegateKey(delegate),
+		name: fmt.Sprintf("network %s", getDelegateName(delegate)),
+	})
+}
+
+// record the DEL of a network attachment set up by a previous ADD, done
+// to redo its ADD; it's no longer attached unless its redone ADD is
+func (tx *addTransaction) recordDeleted(delegate map[string]interface{}) {
+	tx.record(addStep{
+		key:     getDelegateKey(delegate),
+		name:    fmt.Sprintf("network %s", getDelegateName(delegate)),
+		deleted: true,
+	})
+}
+
+// record the routing of a network attachment, its rules are removed from
+// the Pod's netns like on a DEL
+func (tx *addTransaction) recordPodRouting(cc *cniContext, delegate map[string]interface{}) {
+	if routing, _ := getPodRouting(delegate); routing == nil || routing.RoutingTable == 0 {
+		return
+	}
+	tx.record(addStep{
+		key:  getDelegateKey(delegate),
+		name: fmt.Sprintf("network %s routing", getDelegateName(delegate)),
+		undo: func() error {
+			return cc.clearPodRouting(delegate)
+		},
+	})
+}
+
+// undo the steps of the transaction in reverse order, every step is undone
+// even when some of them fail; returns the delegates that are still
+// attached, to be recorded in place of the current ones (i.e. the ones
+// recorded by the previous ADDs): the current ones this ADD didn't delete
+// and, among the given ones, the ones that were already attached and the
+// ones that have a step that failed to be undone; along with an error
+// listing each of the steps that failed to be undone
+func (tx *addTransaction) rollback(current, delegates []map[string]interface{}) ([]map[string]interface{}, error) {
+	tx.mu.Lock()
+	defer tx.mu.Unlock()
+
+	attachedKeys := make(map[string]bool)
+	deletedKeys := make(map[string]bool)
+	var failures []string
+	for i := len(tx.steps) - 1; i >= 0; i-- {
+		step := tx.steps[i]
+		if step.deleted {
+			deletedKeys[step.key] = true
+			continue
+		}
+		if step.undo == nil {
+			kc.LogDebug("rollback: keeping %s, it was already attached\n", step.name)
+			attachedKeys[step.key] = true
+			continue
+		}
+		kc.LogDebug("rollback: undoing the ADD of %s\n", step.name)
+		if err := step.undo(); err != nil {
+			kc.LogError("rollback: failed to undo the ADD of %s: %v\n", step.name, err)
+			failures = append(failures, fmt.Sprintf("%s: %v", step.name, err))
+			attachedKeys[step.key] = true
+		}
+	}
+	tx.steps = nil
+
+	var attached, deleted []map[string]interface{}
+	for _, delegate := range delegates {
+		if attachedKeys[getDelegateKey(delegate)] {
+			attached = append(attached, delegate)
+		}
+	}
+	for _, delegate := range current {
+		if deletedKeys[getDelegateKey(delegate)] {
+			deleted = append(deleted, delegate)
+		}
+	}
+	remaining := mergeDelegates(removeDelegates(current, deleted), attached)
+	if len(failures) == 0 {
+		return remaining, nil
+	}
+	return remaining, fmt.Errorf("the rollback failed for %d step(s): %s", len(failures), strings.Join(failures, "; "))
+}
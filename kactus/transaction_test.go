@@ -0,0 +1,136 @@
+/*
+Copyright (c) 2021 Kaloom Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+)
+
+func TestRollback(t *testing.T) {
+	delegate := func(name, cniVersion string) map[string]interface{} {
+		return map[string]interface{}{"networkName": name, "type": "fake", "cniVersion": cniVersion}
+	}
+	added := func(name string, err error) addStep {
+		return addStep{key: name, name: "network " + name, undo: func() error { return err }}
+	}
+	names := func(delegates []map[string]interface{}) []string {
+		var names []string
+		for _, d := range delegates {
+			names = append(names, fmt.Sprintf("%s@%s", d["networkName"], d["cniVersion"]))
+		}
+		return names
+	}
+
+	tests := []struct {
+		name      string
+		current   []map[string]interface{}
+		delegates []map[string]interface{}
+		steps     func(tx *addTransaction)
+		remaining []string
+		err       bool
+	}{
+		{
+			name:      "first ADD",
+			delegates: []map[string]interface{}{delegate("a", "1"), delegate("b", "1")},
+			steps: func(tx *addTransaction) {
+				tx.record(added("a", nil))
+			},
+		},
+		{
+			name:      "previous attachments not reached are kept",
+			current:   []map[string]interface{}{delegate("a", "1"), delegate("b", "1")},
+			delegates: []map[string]interface{}{delegate("a", "1"), delegate("b", "1"), delegate("c", "1")},
+			steps: func(tx *addTransaction) {
+				tx.record(added("c", nil))
+			},
+			remaining: []string{"a@1", "b@1"},
+		},
+		{
+			name:      "previous attachments torn down to be redone are dropped",
+			current:   []map[string]interface{}{delegate("a", "1"), delegate("b", "1")},
+			delegates: []map[string]interface{}{delegate("a", "1"), delegate("b", "1")},
+			steps: func(tx *addTransaction) {
+				tx.recordDeleted(delegate("a", "1"))
+				tx.record(added("a", nil))
+				tx.recordDeleted(delegate("b", "1"))
+			},
+		},
+		{
+			name:      "already attached are kept",
+			current:   []map[string]interface{}{delegate("a", "1")},
+			delegates: []map[string]interface{}{delegate("a", "1"), delegate("b", "1")},
+			steps: func(tx *addTransaction) {
+				tx.recordAttached(delegate("a", "1"))
+				tx.record(added("b", nil))
+			},
+			remaining: []string{"a@1"},
+		},
+		{
+			name:      "failed undos are kept with their new netconf",
+			current:   []map[string]interface{}{delegate("a", "1")},
+			delegates: []map[string]interface{}{delegate("a", "2"), delegate("b", "2")},
+			steps: func(tx *addTransaction) {
+				tx.recordDeleted(delegate("a", "1"))
+				tx.record(added("a", fmt.Errorf("failed")))
+				tx.record(added("b", fmt.Errorf("failed")))
+			},
+			remaining: []string{"a@2", "b@2"},
+			err:       true,
+		},
+		{
+			name:      "previous attachment with a changed netconf is kept with its netconf",
+			current:   []map[string]interface{}{delegate("a", "1")},
+			delegates: []map[string]interface{}{delegate("a", "2")},
+			steps:     func(tx *addTransaction) {},
+			remaining: []string{"a@1"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tx := &addTransaction{}
+			tt.steps(tx)
+			remaining, err := tx.rollback(tt.current, tt.delegates)
+			if (err != nil) != tt.err {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if got := names(remaining); !reflect.DeepEqual(got, tt.remaining) {
+				t.Errorf("expected the remaining delegates %v, got %v", tt.remaining, got)
+			}
+		})
+	}
+}
+
+func TestRollbackUndoOrder(t *testing.T) {
+	var undone []string
+	tx := &addTransaction{}
+	for _, name := range []string{"a", "b", "c"} {
+		name := name
+		tx.record(addStep{key: name, name: name, undo: func() error {
+			undone = append(undone, name)
+			return nil
+		}})
+	}
+	if _, err := tx.rollback(nil, nil); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if expected := []string{"c", "b", "a"}; !reflect.DeepEqual(undone, expected) {
+		t.Errorf("expected the steps to be undone in order %v, got %v", expected, undone)
+	}
+}
@@ -0,0 +1,210 @@
+/*
+Copyright (c) 2021 Kaloom Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	kc "github.com/kaloom/kubernetes-common"
+)
+
+// the upperLayers of a network attachment in the networks Pod annotation
+// are the network attachments whose device sits on top of its device (ex.
+// a vlan on top of a bond, a macvlan on top of a sriov VF); the lower
+// layers of a network attachment are added before it and deleted after
+// it, and the device names of its lower layers are passed to its delegate
+
+// the field kactus sets in the netconf of a delegate with the names of the
+// network attachments it's an upper layer of
+const lowerLayersField = "lowerLayers"
+
+// returns the names of the lower layer networks of a delegate
+func getLowerLayers(delegate map[string]interface{}) []string {
+	var lowers []string
+	switch l := delegate[lowerLayersField].(type) {
+	case []string:
+		lowers = l
+	case []interface{}:
+		for _, name := range l {
+			if isString(name) {
+				lowers = append(lowers, name.(string))
+			}
+		}
+	}
+	return lowers
+}
+
+// group nodes in layers where a node comes after all its lower nodes, the
+// nodes of a layer are in their original order; lower nodes that aren't
+// in the given nodes are ignored. An error is returned on a cycle
+func getLayers(names []string, lowers [][]string) ([][]int, error) {
+	index := make(map[string]int, len(names))
+	for i, name := range names {
+		index[name] = i
+	}
+
+	level := make([]int, len(names))
+	for i := range level {
+		level[i] = -1
+	}
+	var layers [][]int
+	for placed := 0; placed < len(names); {
+		var layer []int
+		for i := range names {
+			if level[i] >= 0 {
+				continue
+			}
+			ready := true
+			for _, lower := range lowers[i] {
+				if j, ok := index[lower]; ok && level[j] < 0 {
+					ready = false
+					break
+				}
+			}
+			if ready {
+				layer = append(layer, i)
+			}
+		}
+		if len(layer) == 0 {
+			var cycle []string
+			for i, name := range names {
+				if level[i] < 0 {
+					cycle = append(cycle, name)
+				}
+			}
+			sort.Strings(cycle)
+			return nil, fmt.Errorf("the upper layers of networks %s form a cycle", strings.Join(cycle, ", "))
+		}
+		for _, i := range layer {
+			level[i] = len(layers)
+		}
+		layers = append(layers, layer)
+		placed += len(layer)
+	}
+	return layers, nil
+}
+
+// validate the upper layers of the network attachments, an upper layer
+// must be another auxiliary network attachment of the Pod and the upper
+// layers must not form a cycle
+func validateUpperLayers(networks []networkConfig) error {
+	names := make([]string, len(networks))
+	present := make(map[string]bool, len(networks))
+	for i, podNet := range networks {
+		names[i] = podNet.NetworkName
+		present[podNet.NetworkName] = !podNet.IsPrimary
+	}
+
+	lowers := make(map[string][]string)
+	for _, podNet := range networks {
+		if len(podNet.UpperLayers) == 0 {
+			continue
+		}
+		if podNet.IsPrimary {
+			return fmt.Errorf("Network %s is primary, it can't have upper layers", podNet.NetworkName)
+		}
+		for _, upper := range podNet.UpperLayers {
+			if upper == podNet.NetworkName {
+				return fmt.Errorf("Network %s can't be an upper layer of itself", podNet.NetworkName)
+			}
+			isAux, ok := present[upper]
+			if !ok {
+				return fmt.Errorf("Network %s has upper layer %s which is not a network of the Pod", podNet.NetworkName, upper)
+			}
+			if !isAux {
+				return fmt.Errorf("Network %s has upper layer %s which is primary", podNet.NetworkName, upper)
+			}
+			lowers[upper] = append(lowers[upper], podNet.NetworkName)
+		}
+	}
+	if len(lowers) == 0 {
+		return nil
+	}
+
+	networkLowers := make([][]string, len(networks))
+	for i, name := range names {
+		networkLowers[i] = lowers[name]
+	}
+	_, err := getLayers(names, networkLowers)
+	return err
+}
+
+// set the lower layers of the delegates off the upper layers of their
+// network attachments
+func setLowerLayers(networks []networkConfig, delegates []map[string]interface{}) {
+	index := make(map[string]int, len(networks))
+	for i, podNet := range networks {
+		index[podNet.NetworkName] = i
+	}
+	for _, podNet := range networks {
+		for _, upper := range podNet.UpperLayers {
+			i, ok := index[upper]
+			if !ok {
+				continue
+			}
+			lowers, _ := delegates[i][lowerLayersField].([]interface{})
+			delegates[i][lowerLayersField] = append(lowers, podNet.NetworkName)
+		}
+	}
+}
+
+// group the delegates in layers where a delegate comes after the
+// delegates of its lower layers, see getLayers
+func getDelegateLayers(delegates []map[string]interface{}) ([][]int, error) {
+	names := make([]string, len(delegates))
+	lowers := make([][]string, len(delegates))
+	for i, delegate := range delegates {
+		names[i] = getDelegateKey(delegate)
+		lowers[i] = getLowerLayers(delegate)
+	}
+	return getLayers(names, lowers)
+}
+
+// returns a copy of the netconf and CNI_ARGS of a delegate with the
+// device names of its lower layers: they're passed in the
+// K8S_POD_LOWER_IFNAMES CNI_ARGS key (comma separated) and a delegate that
+// isn't a plugin chain and has a single lower layer gets its device name as
+// its 'master', like the vlan, macvlan and ipvlan plugins expect, along
+// with 'linkInContainer' since the lower device is in the Pod's netns
+func (cc *cniContext) withLowerLayers(argIfName string, netconf map[string]interface{}, pluginArgs [][2]string) (map[string]interface{}, [][2]string) {
+	lowers := getLowerLayers(netconf)
+	if len(lowers) == 0 {
+		return netconf, pluginArgs
+	}
+
+	ifNames := make([]string, 0, len(lowers))
+	for _, lower := range lowers {
+		ifNames = append(ifNames, cc.getIfName(argIfName, map[string]interface{}{"networkName": lower}))
+	}
+	pluginArgs = setCNIArg(pluginArgs, "K8S_POD_LOWER_IFNAMES", strings.Join(ifNames, ","))
+	if isPluginChain(netconf) || len(ifNames) != 1 {
+		return netconf, pluginArgs
+	}
+
+	if master, ok := netconf["master"]; ok && master != ifNames[0] {
+		kc.LogDebug("withLowerLayers: network %s: overriding the master %v with its lower layer device %s\n", getDelegateName(netconf), master, ifNames[0])
+	}
+	conf := make(map[string]interface{}, len(netconf)+2)
+	for k, v := range netconf {
+		conf[k] = v
+	}
+	conf["master"] = ifNames[0]
+	conf["linkInContainer"] = true
+	return conf, pluginArgs
+}
@@ -0,0 +1,162 @@
+/*
+Copyright (c) 2021 Kaloom Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	kc "github.com/kaloom/kubernetes-common"
+)
+
+func TestGetLayers(t *testing.T) {
+	tests := []struct {
+		name   string
+		names  []string
+		lowers [][]string
+		layers [][]int
+		err    string
+	}{
+		{
+			name:   "no lower layers",
+			names:  []string{"a", "b", "c"},
+			lowers: [][]string{nil, nil, nil},
+			layers: [][]int{{0, 1, 2}},
+		},
+		{
+			name:   "vlan on top of a bond on top of two VFs",
+			names:  []string{"vlan100", "bond", "vf1", "vf2"},
+			lowers: [][]string{{"bond"}, {"vf1", "vf2"}, nil, nil},
+			layers: [][]int{{2, 3}, {1}, {0}},
+		},
+		{
+			name:   "a node comes after its deepest lower node",
+			names:  []string{"top", "mid", "bottom"},
+			lowers: [][]string{{"mid", "bottom"}, {"bottom"}, nil},
+			layers: [][]int{{2}, {1}, {0}},
+		},
+		{
+			name:   "unknown lower nodes are ignored",
+			names:  []string{"a", "b"},
+			lowers: [][]string{{"unknown"}, {"a"}},
+			layers: [][]int{{0}, {1}},
+		},
+		{
+			name:   "two nodes cycle",
+			names:  []string{"a", "b", "c"},
+			lowers: [][]string{{"b"}, {"a"}, nil},
+			err:    "the upper layers of networks a, b form a cycle",
+		},
+		{
+			name:   "self cycle",
+			names:  []string{"a"},
+			lowers: [][]string{{"a"}},
+			err:    "the upper layers of networks a form a cycle",
+		},
+		{
+			name:   "nodes on top of a cycle",
+			names:  []string{"d", "c", "b", "a"},
+			lowers: [][]string{{"c"}, {"b"}, {"c"}, nil},
+			err:    "the upper layers of networks b, c, d form a cycle",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			layers, err := getLayers(tt.names, tt.lowers)
+			if tt.err != "" {
+				if err == nil || err.Error() != tt.err {
+					t.Fatalf("expected error %q, got %v", tt.err, err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !reflect.DeepEqual(layers, tt.layers) {
+				t.Errorf("expected layers %v, got %v", tt.layers, layers)
+			}
+		})
+	}
+}
+
+func TestValidateUpperLayers(t *testing.T) {
+	network := func(name string, isPrimary bool, upperLayers ...string) networkConfig {
+		return networkConfig{NetworkConfig: kc.NetworkConfig{NetworkName: name, IsPrimary: isPrimary, UpperLayers: upperLayers}}
+	}
+
+	tests := []struct {
+		name     string
+		networks []networkConfig
+		err      string
+	}{
+		{
+			name:     "no upper layers",
+			networks: []networkConfig{network("a", true), network("b", false)},
+		},
+		{
+			name: "vlan on top of a bond on top of two VFs",
+			networks: []networkConfig{
+				network("vf1", false, "bond"),
+				network("vf2", false, "bond"),
+				network("bond", false, "vlan100"),
+				network("vlan100", false),
+			},
+		},
+		{
+			name:     "primary network with upper layers",
+			networks: []networkConfig{network("a", true, "b"), network("b", false)},
+			err:      "Network a is primary, it can't have upper layers",
+		},
+		{
+			name:     "primary upper layer",
+			networks: []networkConfig{network("a", true), network("b", false, "a")},
+			err:      "Network b has upper layer a which is primary",
+		},
+		{
+			name:     "upper layer of itself",
+			networks: []networkConfig{network("a", false, "a")},
+			err:      "Network a can't be an upper layer of itself",
+		},
+		{
+			name:     "upper layer not in the Pod",
+			networks: []networkConfig{network("a", false, "b")},
+			err:      "Network a has upper layer b which is not a network of the Pod",
+		},
+		{
+			name:     "cycle",
+			networks: []networkConfig{network("a", false, "b"), network("b", false, "c"), network("c", false, "a")},
+			err:      "form a cycle",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := validateUpperLayers(tt.networks)
+			if tt.err == "" {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Fatalf("expected error %q, got %v", tt.err, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,281 @@
+/*
+Copyright (c) 2021 Kaloom Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+
+	kc "github.com/kaloom/kubernetes-common"
+
+	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+
+	"github.com/containernetworking/cni/pkg/types"
+
+	"github.com/kaloom/kubernetes-kactus-cni-plugin/pkg/client/clientset/versioned"
+)
+
+// a validating admission webhook, run by the "kactus webhook" subcommand,
+// that rejects the Network CRs and the Pods networks annotations that
+// would make the ADD of a sandbox fail; it uses the same parsing and
+// validation as the ADD
+
+const (
+	defaultWebhookListen = ":8443"
+
+	// the max. size of an AdmissionReview request body
+	maxAdmissionReviewSize = 4 << 20
+)
+
+// the subset of the admission.k8s.io/v1 AdmissionReview kactus uses
+type admissionReview struct {
+	APIVersion string             `json:"apiVersion"`
+	Kind       string             `json:"kind"`
+	Request    *admissionRequest  `json:"request,omitempty"`
+	Response   *admissionResponse `json:"response,omitempty"`
+}
+
+type admissionRequest struct {
+	UID       string                  `json:"uid"`
+	Kind      metav1.GroupVersionKind `json:"kind"`
+	Namespace string                  `json:"namespace,omitempty"`
+	Operation string                  `json:"operation"`
+	Object    json.RawMessage         `json:"object,omitempty"`
+	OldObject json.RawMessage         `json:"oldObject,omitempty"`
+}
+
+type admissionResponse struct {
+	UID     string         `json:"uid"`
+	Allowed bool           `json:"allowed"`
+	Result  *metav1.Status `json:"status,omitempty"`
+}
+
+type webhook struct {
+	netconf   *netConf
+	k8sclient *kubernetes.Clientset
+	netclient versioned.Interface
+}
+
+// validate a Network CR the way its netconf gets built on ADD
+func validateNetObject(no *netObject) error {
+	netconf, err := getPluginNetConf(no, "", "", false)
+	if err != nil {
+		return err
+	}
+	var masterpluginEnabled bool
+	if err := checkDelegate(netconf, &masterpluginEnabled); err != nil {
+		return fmt.Errorf("Kactus: network %s/%s: %v", no.Namespace, no.Name, err)
+	}
+	routing := podRouting{Routes: no.Spec.Routes, RoutingTable: no.Spec.RoutingTable}
+	if err := routing.validate(false); err != nil {
+		return fmt.Errorf("Kactus: network %s/%s: %v", no.Namespace, no.Name, err)
+	}
+	return nil
+}
+
+// validate the networks annotation of a Pod the way it's validated on
+// ADD, the networks it refers to must exist
+func (wh *webhook) validatePod(pod *v1.Pod, namespace string) error {
+	annotKey, netAnnot := getNetworksAnnotation(pod, wh.netconf.CRDLookupOrder)
+	if netAnnot == "" {
+		return nil
+	}
+	networks, err := parseNetworksAnnotation(annotKey, netAnnot)
+	if err != nil {
+		return err
+	}
+	// the Pod's primary device name is only known on ADD, it's eth0 with
+	// the container runtimes kactus is used with
+	if _, err := validatePodNetworksConfig(networks, "eth0"); err != nil {
+		return fmt.Errorf("Kactus: %v", err)
+	}
+
+	cc := &cniContext{
+		cniArgs:   &CNIArgs{K8S_POD_NAMESPACE: types.UnmarshallableString(namespace)},
+		k8sclient: wh.k8sclient,
+		netclient: wh.netclient,
+		netconf:   wh.netconf,
+	}
+	for _, podNet := range networks {
+		if _, err := cc.getNetObject(podNet); err != nil {
+			return prefixError("Kactus: ", err)
+		}
+	}
+	return nil
+}
+
+// validate the object of an admission request, nil is returned for the
+// objects and operations kactus doesn't validate
+func (wh *webhook) validate(req *admissionRequest) error {
+	if req.Operation != "CREATE" && req.Operation != "UPDATE" {
+		return nil
+	}
+
+	switch {
+	case req.Kind.Group == "" && req.Kind.Kind == "Pod":
+		pod := &v1.Pod{}
+		if err := json.Unmarshal(req.Object, pod); err != nil {
+			return fmt.Errorf("failed to decode the Pod: %v", err)
+		}
+		if req.Operation == "UPDATE" && len(req.OldObject) > 0 {
+			// an update that doesn't touch the networks annotation
+			// is let through, a network may be gone since the Pod
+			// got created
+			old := &v1.Pod{}
+			if err := json.Unmarshal(req.OldObject, old); err == nil {
+				oldKey, oldAnnot := getNetworksAnnotation(old, wh.netconf.CRDLookupOrder)
+				key, annot := getNetworksAnnotation(pod, wh.netconf.CRDLookupOrder)
+				if oldKey == key && oldAnnot == annot {
+					return nil
+				}
+			}
+		}
+		namespace := pod.Namespace
+		if namespace == "" {
+			namespace = req.Namespace
+		}
+		return wh.validatePod(pod, namespace)
+	case req.Kind.Group == crdGroupName || req.Kind.Group == npwgGroupName:
+		no, err := unmarshalNetObject(req.Kind.Group, req.Object)
+		if err != nil {
+			return fmt.Errorf("Kactus: invalid %s: %v", req.Kind.Kind, err)
+		}
+		return validateNetObject(no)
+	}
+	return nil
+}
+
+func (wh *webhook) serveValidate(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "only POST is supported", http.StatusMethodNotAllowed)
+		return
+	}
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxAdmissionReviewSize))
+	if err != nil {
+		http.Error(w, fmt.Sprintf("failed to read the request: %v", err), http.StatusBadRequest)
+		return
+	}
+	review := &admissionReview{}
+	if err := json.Unmarshal(body, review); err != nil || review.Request == nil {
+		http.Error(w, "the request is not an AdmissionReview", http.StatusBadRequest)
+		return
+	}
+
+	req := review.Request
+	resp := &admissionResponse{UID: req.UID, Allowed: true}
+	if err := wh.validate(req); err != nil {
+		kc.LogInfo("serveValidate: rejecting %s %s %s/%s: %v\n", req.Operation, req.Kind.Kind, req.Namespace, getObjectName(req.Object), err)
+		resp.Allowed = false
+		resp.Result = &metav1.Status{
+			Status:  metav1.StatusFailure,
+			Message: err.Error(),
+			Reason:  metav1.StatusReasonInvalid,
+			Code:    http.StatusUnprocessableEntity,
+		}
+		// a network that is not found or that the webhook is not
+		// allowed to get is reported with the apiserver's status
+		if status, ok := err.(apierrors.APIStatus); ok {
+			s := status.Status()
+			resp.Result = &s
+		}
+	}
+
+	out, err := json.Marshal(&admissionReview{
+		APIVersion: review.APIVersion,
+		Kind:       review.Kind,
+		Response:   resp,
+	})
+	if err != nil {
+		http.Error(w, fmt.Sprintf("failed to encode the response: %v", err), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(out)
+}
+
+// the name of the object of an admission request, used in log messages
+func getObjectName(object json.RawMessage) string {
+	meta := struct {
+		metav1.ObjectMeta `json:"metadata"`
+	}{}
+	if err := json.Unmarshal(object, &meta); err != nil {
+		return ""
+	}
+	if meta.Name == "" {
+		return meta.GenerateName
+	}
+	return meta.Name
+}
+
+// the "kactus webhook" subcommand, it serves the admission webhook over
+// https until it fails
+func cmdWebhook(argv []string) int {
+	flags := flag.NewFlagSet("webhook", flag.ContinueOnError)
+	confFile := flags.String("conf", defaultConfFile, "kactus cni-plugin config file")
+	listen := flags.String("listen", defaultWebhookListen, "the address the webhook listens on")
+	certFile := flags.String("tls-cert-file", "", "the file of the webhook's x509 certificate")
+	keyFile := flags.String("tls-key-file", "", "the file of the webhook's x509 private key")
+	if err := flags.Parse(argv); err != nil {
+		return 2
+	}
+	if *certFile == "" || *keyFile == "" {
+		fmt.Fprintf(os.Stderr, "-tls-cert-file and -tls-key-file are required\n")
+		return 2
+	}
+
+	data, err := ioutil.ReadFile(*confFile)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to read %s: %v\n", *confFile, err)
+		return 1
+	}
+	nc, err := loadNetConf(data)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		return 1
+	}
+	k8sclient, err := createK8sClient(nc)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		return 1
+	}
+	netclient, err := createNetworkClient(nc)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		return 1
+	}
+
+	wh := &webhook{netconf: nc, k8sclient: k8sclient, netclient: netclient}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/validate", wh.serveValidate)
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("ok"))
+	})
+
+	kc.LogInfo("cmdWebhook: listening on %s\n", *listen)
+	if err := http.ListenAndServeTLS(*listen, *certFile, *keyFile, mux); err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,63 @@
+/*
+Copyright (c) 2021 Kaloom Inc.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package v1
+
+import (
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// +genclient
+// +k8s:deepcopy-gen:interfaces=k8s.io/apimachinery/pkg/runtime.Object
+
+// Network is a network attachment definition, a Pod gets attached to it by
+// referring to it in its networks annotation
+type Network struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty" description:"standard object metadata"`
+
+	Spec NetworkSpec `json:"spec"`
+}
+
+// NetworkSpec is the desired state of a network attachment
+type NetworkSpec struct {
+	// Plugin is the CNI plugin to use, a copy of the "type" of Config
+	Plugin string `json:"plugin"`
+	// Config is a JSON-formatted CNI configuration
+	Config string `json:"config"`
+	// Routes are routes through the network device of the attachments
+	Routes []Route `json:"routes,omitempty"`
+	// RoutingTable is a routing table dedicated to the network device of
+	// the attachments, looked up by the traffic sourced from its addresses
+	RoutingTable int `json:"routingTable,omitempty"`
+}
+
+// Route is a route through the network device of an attachment, a route
+// without a gateway is on link
+type Route struct {
+	Dst string `json:"dst"`
+	GW  string `json:"gw,omitempty"`
+}
+
+// +k8s:deepcopy-gen:interfaces=k8s.io/apimachinery/pkg/runtime.Object
+
+// NetworkList is a list of Networks
+type NetworkList struct {
+	metav1.TypeMeta `json:",inline"`
+	metav1.ListMeta `json:"metadata,omitempty"`
+
+	Items []Network `json:"items"`
+}
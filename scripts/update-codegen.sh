@@ -0,0 +1,32 @@
+#!/usr/bin/env bash
+
+# regenerate the deepcopy functions, the clientset, the listers and the
+# informers of the kaloom.com/v1 API types (pkg/apis/kaloom/v1) with the
+# Kubernetes code generators, then vendor what the generated code imports
+
+set -euo pipefail
+
+cd "$(dirname "$(readlink -f "${BASH_SOURCE[0]}")")/.."
+
+REPO_PATH=github.com/kaloom/kubernetes-kactus-cni-plugin
+CODEGEN_VERSION=${CODEGEN_VERSION:-v0.18.3}
+
+export GOFLAGS=-mod=mod
+
+codegen_dir=$(go mod download -json k8s.io/code-generator@${CODEGEN_VERSION} | sed -n 's/^[[:space:]]*"Dir": "\(.*\)",$/\1/p')
+[ -n "$codegen_dir" ] || (echo "failed to download k8s.io/code-generator@${CODEGEN_VERSION}"; exit 1)
+
+output_base=$(mktemp -d)
+trap 'rm -rf "$output_base"' EXIT
+
+bash ${codegen_dir}/generate-groups.sh "deepcopy,client,lister,informer" \
+     ${REPO_PATH}/pkg/client ${REPO_PATH}/pkg/apis kaloom:v1 \
+     --output-base "$output_base" \
+     --go-header-file scripts/boilerplate.go.txt
+
+cp -r ${output_base}/${REPO_PATH}/pkg/. pkg/
+
+# the listers and the informers use k8s.io/client-go/tools/cache and the
+# fake clientset k8s.io/client-go/testing
+go mod tidy
+go mod vendor